@@ -0,0 +1,163 @@
+package s3driver
+
+import (
+	"code.cloudfoundry.org/lager"
+	"encoding/json"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"strconv"
+	"time"
+)
+
+const (
+	boltStateFileName = "driver-state.db"
+	// boltStateVersion is the schema version of the volumes in the bolt
+	// store, recorded in its meta bucket.
+	boltStateVersion = 1
+)
+
+var (
+	boltVolumesBucket    = []byte("volumes")
+	boltQuarantineBucket = []byte("quarantine")
+	boltMetaBucket       = []byte("meta")
+	boltVersionKey       = []byte("version")
+)
+
+// boltStateStore keeps each volume under its own key, so that a change
+// writes that volume only, in a transaction.
+type boltStateStore struct {
+	logger lager.Logger
+	db     *bbolt.DB
+}
+
+func openBoltStateStore(logger lager.Logger, path string) (*boltStateStore, error) {
+	// another driver still holding the store must not wait forever
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open state store %s: %s", path, err.Error())
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{boltVolumesBucket, boltQuarantineBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+
+		if raw := meta.Get(boltVersionKey); raw != nil {
+			version, err := strconv.Atoi(string(raw))
+			if err != nil {
+				return fmt.Errorf("invalid state store version '%s'", raw)
+			}
+			if version > boltStateVersion {
+				return errNewerState
+			}
+			return nil
+		}
+		return meta.Put(boltVersionKey, []byte(strconv.Itoa(boltStateVersion)))
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStateStore{
+		logger: logger.Session("bolt-state-store", lager.Data{"path": path}),
+		db:     db,
+	}, nil
+}
+
+// Load returns the stored volumes. Entries which cannot be decoded are moved
+// to the quarantine bucket for investigation.
+func (s *boltStateStore) Load() (map[string]*S3VolumeInfo, error) {
+	volumes := map[string]*S3VolumeInfo{}
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(boltVolumesBucket)
+
+		corrupted := map[string][]byte{}
+		err := bucket.ForEach(func(key, value []byte) error {
+			volume := &S3VolumeInfo{}
+			if err := json.Unmarshal(value, volume); err != nil {
+				s.logger.Error("volume-quarantined", err, lager.Data{"volume": string(key)})
+				corrupted[string(key)] = append([]byte{}, value...)
+				return nil
+			}
+			volumes[string(key)] = volume
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		quarantine := tx.Bucket(boltQuarantineBucket)
+		for name, value := range corrupted {
+			if err := quarantine.Put([]byte(name), value); err != nil {
+				return err
+			}
+			if err := bucket.Delete([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return volumes, nil
+}
+
+func (s *boltStateStore) Get(name string) (*S3VolumeInfo, error) {
+	volume := &S3VolumeInfo{}
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		value := tx.Bucket(boltVolumesBucket).Get([]byte(name))
+		if value == nil {
+			return errVolumeNotStored
+		}
+		return json.Unmarshal(value, volume)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return volume, nil
+}
+
+func (s *boltStateStore) Put(volume *S3VolumeInfo) error {
+	return s.putAll(map[string]*S3VolumeInfo{volume.Name: volume})
+}
+
+func (s *boltStateStore) Delete(name string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltVolumesBucket).Delete([]byte(name))
+	})
+}
+
+// putAll stores volumes in a single transaction.
+func (s *boltStateStore) putAll(volumes map[string]*S3VolumeInfo) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(boltVolumesBucket)
+		for name, volume := range volumes {
+			value, err := json.Marshal(volume)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(name), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStateStore) empty() (bool, error) {
+	empty := true
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		key, _ := tx.Bucket(boltVolumesBucket).Cursor().First()
+		empty = key == nil
+		return nil
+	})
+	return empty, err
+}
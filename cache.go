@@ -0,0 +1,187 @@
+package s3driver
+
+import (
+	"code.cloudfoundry.org/dockerdriver"
+	"code.cloudfoundry.org/lager"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// volumeCache hands out local cache directories to volumes, within a quota
+// per volume and a quota shared by all the volumes of the cell.
+type volumeCache struct {
+	root        string
+	volumeQuota int64
+	globalQuota int64
+
+	lock     sync.Mutex
+	reserved map[string]int64
+}
+
+func newVolumeCache(root string, volumeQuota, globalQuota int64) *volumeCache {
+	return &volumeCache{
+		root:        root,
+		volumeQuota: volumeQuota,
+		globalQuota: globalQuota,
+		reserved:    map[string]int64{},
+	}
+}
+
+func (c *volumeCache) enabled() bool {
+	return c.root != ""
+}
+
+func (c *volumeCache) dir(volumeName string) string {
+	return filepath.Join(c.root, volumeName)
+}
+
+// size is the quota of a volume asking for cacheSize, which defaults to the
+// per-volume quota.
+func (c *volumeCache) size(cacheSize string) (int64, error) {
+	if cacheSize == "" {
+		return c.volumeQuota, nil
+	}
+	size, err := ParseSize(cacheSize)
+	if err != nil || size <= 0 {
+		return 0, errors.New("'cache_size' must be a positive size such as '512M' or '10G'")
+	}
+	if size > c.volumeQuota {
+		return 0, fmt.Errorf("'cache_size' must not exceed the per-volume quota of %d bytes", c.volumeQuota)
+	}
+	return size, nil
+}
+
+// reserve books size bytes of the global quota for a volume. A volume which
+// already holds a reservation keeps it.
+func (c *volumeCache) reserve(volumeName string, size int64) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.reserved[volumeName]; ok {
+		return true
+	}
+
+	if c.globalQuota > 0 {
+		var total int64
+		for _, reserved := range c.reserved {
+			total += reserved
+		}
+		if total+size > c.globalQuota {
+			return false
+		}
+	}
+	c.reserved[volumeName] = size
+	return true
+}
+
+func (c *volumeCache) release(volumeName string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.reserved, volumeName)
+}
+
+// reserveCache returns the cache directory and quota of a volume, or an
+// empty directory when the volume is not cached.
+func (d *S3Driver) reserveCache(logger lager.Logger, volumeName string, connInfo ConnectionInfo) (string, int64) {
+	if !connInfo.Cache || !d.cache.enabled() {
+		return "", 0
+	}
+
+	size, err := d.cache.size(connInfo.CacheSize)
+	if err != nil {
+		logger.Error("invalid-cache-size", err)
+		return "", 0
+	}
+
+	if !d.cache.reserve(volumeName, size) {
+		logger.Info("cache-global-quota-exhausted", lager.Data{"warning": "volume is mounted without local cache"})
+		return "", 0
+	}
+	return d.cache.dir(volumeName), size
+}
+
+// wipeCache releases the cache of a volume and removes its content. The
+// backing mount living in the cache directory must be gone first, removing
+// files through it would delete objects from the bucket.
+func (d *S3Driver) wipeCache(env dockerdriver.Env, volumeName string) {
+	if !d.cache.enabled() {
+		return
+	}
+	logger := env.Logger().Session("wipe-cache", lager.Data{"volume": volumeName})
+
+	cacheDir := d.cache.dir(volumeName)
+	backing := cacheBackingDir(cacheDir)
+	mounted, err := d.mountChecker.Exists(backing)
+	if err != nil {
+		logger.Error("check-backing-mount-failed", err)
+		return
+	}
+	if mounted {
+		if err := d.unmountStale(env, backing); err != nil {
+			logger.Error("unmount-backing-failed", err)
+			return
+		}
+	}
+
+	if err := d.os.RemoveAll(cacheDir); err != nil {
+		logger.Error("remove-cache-failed", err)
+		return
+	}
+	d.cache.release(volumeName)
+	logger.Info("cache-wiped")
+}
+
+// cacheBackingDir is where the mounter of a cached volume mounts its bucket,
+// under the cache it serves the mountpoint from.
+func cacheBackingDir(cacheDir string) string {
+	return filepath.Join(cacheDir, "backing")
+}
+
+// drainCache removes every cache directory, used when the cell is drained.
+func (d *S3Driver) drainCache(env dockerdriver.Env) {
+	if !d.cache.enabled() {
+		return
+	}
+	logger := env.Logger().Session("drain-cache")
+
+	d.Purge(env, d.cache.root)
+
+	dirs, err := d.ioutil.ReadDir(d.cache.root)
+	if err != nil {
+		logger.Error("list-cache-failed", err)
+		return
+	}
+	for _, dir := range dirs {
+		d.wipeCache(env, dir.Name())
+	}
+}
+
+var sizeUnits = map[string]int64{
+	"":  1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// ParseSize reads a size in bytes with an optional K, M, G or T suffix.
+func ParseSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	number := strings.TrimRight(size, "KMGTB")
+	unit := strings.TrimSuffix(size[len(number):], "B")
+
+	multiplier, ok := sizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit in '%s'", size)
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size '%s'", size)
+	}
+	return n * multiplier, nil
+}
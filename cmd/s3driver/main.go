@@ -27,6 +27,8 @@ import (
 	"github.com/tedsuo/ifrit/sigmon"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 var atAddress = flag.String(
@@ -112,6 +114,132 @@ var uniqueVolumeIds = flag.Bool(
 	"whether the s3 driver should opt-in to unique volumes",
 )
 
+var stateStore = flag.String(
+	"stateStore",
+	"json",
+	"Where volumes are persisted: 'json' for a state file, 'bolt' for an embedded key-value store importing the state file on first start",
+)
+
+var stateKeyFile = flag.String(
+	"stateKeyFile",
+	"",
+	"Path to the key file (32 bytes, hex or base64 encoded) used to encrypt volume credentials in the state file",
+)
+
+var previousStateKeyFiles = flag.String(
+	"previousStateKeyFiles",
+	"",
+	"Comma separated paths to previous state key files, the state file is re-encrypted with the current key on startup",
+)
+
+var mountConcurrency = flag.Int(
+	"mountConcurrency",
+	8,
+	"Maximum number of mounters starting at once, other mounts are queued (0 for no limit)",
+)
+
+var mountTimeout = flag.Duration(
+	"mountTimeout",
+	30*time.Second,
+	"Maximum time given to a mounter to mount a bucket",
+)
+
+var statCacheTTL = flag.Duration(
+	"statCacheTTL",
+	0,
+	"Default duration goofys caches file attributes, volumes may override it with 'stat_cache_ttl'",
+)
+
+var typeCacheTTL = flag.Duration(
+	"typeCacheTTL",
+	0,
+	"Default duration goofys caches whether a name is a file or a directory, volumes may override it with 'type_cache_ttl'",
+)
+
+var httpTimeout = flag.Duration(
+	"httpTimeout",
+	0,
+	"Default timeout of goofys requests to S3, 0 means no timeout, volumes may override it with 'http_timeout'",
+)
+
+var cheap = flag.Bool(
+	"cheap",
+	false,
+	"Default for reducing S3 operation costs at the expense of some performance, volumes may override it with 'cheap'",
+)
+
+var explicitDir = flag.Bool(
+	"explicitDir",
+	false,
+	"Default for only treating directory marker objects as directories, volumes may override it with 'explicit_dir'",
+)
+
+var cacheRoot = flag.String(
+	"cacheRoot",
+	"",
+	"Path to directory where volumes asking for it get a local read cache, caching is disabled when empty",
+)
+
+var cacheVolumeQuota = flag.String(
+	"cacheVolumeQuota",
+	"10G",
+	"Default and maximum local cache size of a volume",
+)
+
+var cacheGlobalQuota = flag.String(
+	"cacheGlobalQuota",
+	"0",
+	"Maximum local cache size of all volumes together, 0 means no limit",
+)
+
+var catfsPath = flag.String(
+	"catfsPath",
+	"catfs",
+	"Path where to find catfs binary",
+)
+
+var credentialProcess = flag.String(
+	"credentialProcess",
+	"",
+	"Command run by mounters with the volume name as argument to refresh expired session credentials, it prints them in the AWS credential_process JSON format",
+)
+
+var stsEndpoint = flag.String(
+	"stsEndpoint",
+	"",
+	"STS endpoint mounters assume volume roles with, defaults to the AWS one",
+)
+
+var credentialsFile = flag.String(
+	"credentialsFile",
+	"",
+	"Path to a shared credentials file volumes may take their keys from with the 'profile' option",
+)
+
+var trustedCADir = flag.String(
+	"trustedCADir",
+	"",
+	"Path to a directory of PEM files with CAs mounters trust for every endpoint, on top of the system ones",
+)
+
+var allowInsecureSkipVerify = flag.Bool(
+	"allowInsecureSkipVerify",
+	false,
+	"Allow volumes to skip endpoint certificate verification with the 'insecure_skip_verify' option",
+)
+
+var policyFile = flag.String(
+	"policyFile",
+	"",
+	"Path to a JSON policy file restricting the endpoints, buckets, storage classes and mount options volumes may use",
+)
+
+var validateOnCreate = flag.Bool(
+	"validateOnCreate",
+	false,
+	"Check on create that the bucket of a volume can be accessed with its credentials, volumes may override it with 'validate'",
+)
+
 func main() {
 	parseCommandLine()
 
@@ -122,6 +250,54 @@ func main() {
 	logger.Info("start")
 	defer logger.Info("end")
 
+	config := s3driver.Config{
+		StateStore:       *stateStore,
+		MountTimeout:     *mountTimeout,
+		MountConcurrency: *mountConcurrency,
+		DefaultTuning: s3driver.Tuning{
+			StatCacheTTL: *statCacheTTL,
+			TypeCacheTTL: *typeCacheTTL,
+			HTTPTimeout:  *httpTimeout,
+			Cheap:        *cheap,
+			ExplicitDir:  *explicitDir,
+		},
+		CredentialProcess: *credentialProcess,
+		STSEndpoint:       *stsEndpoint,
+		CredentialsFile:   *credentialsFile,
+
+		TrustedCADir:            *trustedCADir,
+		AllowInsecureSkipVerify: *allowInsecureSkipVerify,
+		ValidateOnCreate:        *validateOnCreate,
+	}
+	if *cacheRoot != "" {
+		volumeQuota, err := s3driver.ParseSize(*cacheVolumeQuota)
+		exitOnFailure(logger, err)
+		globalQuota, err := s3driver.ParseSize(*cacheGlobalQuota)
+		exitOnFailure(logger, err)
+		config.CacheRoot = *cacheRoot
+		config.CacheVolumeQuota = volumeQuota
+		config.CacheGlobalQuota = globalQuota
+		config.CatfsPath = *catfsPath
+	}
+
+	if *policyFile != "" {
+		policy, err := s3driver.LoadPolicy(*policyFile)
+		exitOnFailure(logger, err)
+		config.Policy = policy
+	}
+
+	if *stateKeyFile != "" {
+		var previousKeyFiles []string
+		if *previousStateKeyFiles != "" {
+			previousKeyFiles = strings.Split(*previousStateKeyFiles, ",")
+		}
+		keyring, err := s3driver.LoadStateKeyring(*stateKeyFile, previousKeyFiles)
+		exitOnFailure(logger, err)
+		config.StateKeyring = keyring
+	} else {
+		logger.Info("no-state-key-file", lager.Data{"warning": "volume credentials will not be persisted and restored volumes will not remount"})
+	}
+
 	client := s3driver.NewS3Driver(
 		logger,
 		&osshim.OsShim{},
@@ -133,6 +309,7 @@ func main() {
 		oshelper.NewOsHelper(),
 		invoker.NewRealInvoker(),
 		*mounterPath,
+		config,
 	)
 
 	if *transport == "tcp" {
@@ -166,6 +343,9 @@ func main() {
 
 	adminClient.SetServerProc(process)
 	adminClient.RegisterDrainable(client)
+	adminClient.RegisterVolumeLister(client)
+	adminClient.RegisterCredentialsRotator(client)
+	adminClient.RegisterMetricsProvider(client)
 
 	untilTerminated(logger, process)
 }
@@ -248,7 +428,7 @@ func newLogger() (lager.Logger, *lager.ReconfigurableSink) {
 	}
 
 	var err error
-	sink, err = lager.NewRedactingSink(sink, []string{"[Pp]wd", "[Pp]ass", "access_key_id", "secret_access_key", "kmskey_id"}, nil)
+	sink, err = lager.NewRedactingSink(sink, []string{"[Pp]wd", "[Pp]ass", "access_key_id", "secret_access_key", "kmskey_id", "kms_key_id", "session_token", "external_id", "http_proxy", "sse_c_key"}, nil)
 	if err != nil {
 		panic(err)
 	}
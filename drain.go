@@ -2,6 +2,7 @@ package s3driver
 
 import (
 	"code.cloudfoundry.org/dockerdriver"
+	"code.cloudfoundry.org/dockerdriver/driverhttp"
 	"code.cloudfoundry.org/lager"
 	"regexp"
 )
@@ -11,22 +12,55 @@ func (d *S3Driver) Drain(env dockerdriver.Env) error {
 	logger.Info("start")
 	defer logger.Info("end")
 
+	// mounters exiting from now on must not be restarted
+	d.supervisor.stopAll()
+
+	d.volumesLock.RLock()
+	names := make([]string, 0, len(d.volumes))
+	for key := range d.volumes {
+		names = append(names, key)
+	}
+	d.volumesLock.RUnlock()
+
 	// flush any volumes that are still in our map
-	for key, mount := range d.volumes {
-		if mount.Mountpoint != "" && mount.MountCount > 0 {
-			err := d.unmount(logger, mount.Name, mount.Mountpoint, mount.Name)
-			if err != nil {
-				logger.Error("drain-unmount-failed", err, lager.Data{"mount-name": mount.Name, "mount-point": mount.Mountpoint})
-			}
-		}
-		delete(d.volumes, key)
+	for _, key := range names {
+		d.drainVolume(driverhttp.EnvWithLogger(logger, env), key)
 	}
 
 	d.Purge(env, d.mountPathRoot)
-	d.removeState(env)
+	d.drainCache(env)
 	return nil
 }
 
+func (d *S3Driver) drainVolume(env dockerdriver.Env, key string) {
+	logger := env.Logger()
+
+	unlock := d.volumeLocks.lock(key)
+	defer unlock()
+
+	d.volumesLock.RLock()
+	mount, ok := d.volumes[key]
+	d.volumesLock.RUnlock()
+	if !ok {
+		return
+	}
+
+	if mount.Mountpoint != "" && mount.MountCount > 0 {
+		err := d.unmount(logger, mount.Name, mount.Mountpoint, mount.Name)
+		if err != nil {
+			logger.Error("drain-unmount-failed", err, lager.Data{"mount-name": mount.Name, "mount-point": mount.Mountpoint})
+		}
+	}
+
+	d.volumesLock.Lock()
+	delete(d.volumes, key)
+	d.volumesLock.Unlock()
+
+	if err := d.removeVolumeState(env, key); err != nil {
+		logger.Error("drain-remove-volume-state-failed", err, lager.Data{"mount-name": key})
+	}
+}
+
 func (d *S3Driver) Purge(env dockerdriver.Env, path string) {
 	logger := env.Logger().Session("purge")
 	logger.Info("purge-start")
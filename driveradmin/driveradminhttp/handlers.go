@@ -1,6 +1,7 @@
 package driveradminhttp
 
 import (
+	"encoding/json"
 	"errors"
 	"net/http"
 
@@ -19,6 +20,10 @@ func NewHandler(logger lager.Logger, client driveradmin.DriverAdmin) (http.Handl
 	var handlers = rata.Handlers{
 		driveradmin.EvacuateRoute: newEvacuateHandler(logger, client),
 		driveradmin.PingRoute:     newPingHandler(logger, client),
+		driveradmin.VolumesRoute:  newListVolumesHandler(logger, client),
+		driveradmin.MetricsRoute:  newMetricsHandler(logger, client),
+
+		driveradmin.RotateCredentialsRoute: newRotateCredentialsHandler(logger, client),
 	}
 
 	return rata.NewRouter(driveradmin.Routes, handlers)
@@ -61,3 +66,67 @@ func newPingHandler(logger lager.Logger, client driveradmin.DriverAdmin) http.Ha
 		cf_http_handlers.WriteJSONResponse(w, http.StatusOK, response)
 	}
 }
+
+func newListVolumesHandler(logger lager.Logger, client driveradmin.DriverAdmin) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		logger := logger.Session("handle-list-volumes")
+		logger.Info("start")
+		defer logger.Info("end")
+
+		env := driverhttp.EnvWithMonitor(logger, req.Context(), w)
+
+		response := client.ListVolumes(env)
+		if response.Err != "" {
+			logger.Error("failed-listing-volumes", errors.New(response.Err))
+			cf_http_handlers.WriteJSONResponse(w, http.StatusInternalServerError, response)
+			return
+		}
+
+		cf_http_handlers.WriteJSONResponse(w, http.StatusOK, response)
+	}
+}
+
+func newMetricsHandler(logger lager.Logger, client driveradmin.DriverAdmin) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		logger := logger.Session("handle-metrics")
+		logger.Info("start")
+		defer logger.Info("end")
+
+		env := driverhttp.EnvWithMonitor(logger, req.Context(), w)
+
+		response := client.Metrics(env)
+		if response.Err != "" {
+			logger.Error("failed-getting-metrics", errors.New(response.Err))
+			cf_http_handlers.WriteJSONResponse(w, http.StatusInternalServerError, response)
+			return
+		}
+
+		cf_http_handlers.WriteJSONResponse(w, http.StatusOK, response)
+	}
+}
+
+func newRotateCredentialsHandler(logger lager.Logger, client driveradmin.DriverAdmin) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		logger := logger.Session("handle-rotate-credentials")
+		logger.Info("start")
+		defer logger.Info("end")
+
+		var request driveradmin.RotateCredentialsRequest
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			logger.Error("failed-parsing-rotate-credentials-request", err)
+			cf_http_handlers.WriteJSONResponse(w, http.StatusBadRequest, driveradmin.RotateCredentialsResponse{Err: err.Error()})
+			return
+		}
+
+		env := driverhttp.EnvWithMonitor(logger, req.Context(), w)
+
+		response := client.RotateCredentials(env, request)
+		if response.Err != "" {
+			logger.Error("failed-rotating-credentials", errors.New(response.Err))
+			cf_http_handlers.WriteJSONResponse(w, http.StatusInternalServerError, response)
+			return
+		}
+
+		cf_http_handlers.WriteJSONResponse(w, http.StatusOK, response)
+	}
+}
@@ -11,6 +11,9 @@ import (
 type DriverAdminLocal struct {
 	serverProcess ifrit.Process
 	drainables    []driveradmin.Drainable
+	volumeListers []driveradmin.VolumeLister
+	rotators      []driveradmin.CredentialsRotator
+	metrics       []driveradmin.MetricsProvider
 }
 
 func NewDriverAdminLocal() *DriverAdminLocal {
@@ -27,6 +30,18 @@ func (d *DriverAdminLocal) RegisterDrainable(rhs driveradmin.Drainable) {
 	d.drainables = append(d.drainables, rhs)
 }
 
+func (d *DriverAdminLocal) RegisterVolumeLister(rhs driveradmin.VolumeLister) {
+	d.volumeListers = append(d.volumeListers, rhs)
+}
+
+func (d *DriverAdminLocal) RegisterCredentialsRotator(rhs driveradmin.CredentialsRotator) {
+	d.rotators = append(d.rotators, rhs)
+}
+
+func (d *DriverAdminLocal) RegisterMetricsProvider(rhs driveradmin.MetricsProvider) {
+	d.metrics = append(d.metrics, rhs)
+}
+
 func (d *DriverAdminLocal) Evacuate(env dockerdriver.Env) driveradmin.ErrorResponse {
 	logger := env.Logger().Session("evacuate")
 	logger.Info("start")
@@ -54,3 +69,46 @@ func (d *DriverAdminLocal) Ping(env dockerdriver.Env) driveradmin.ErrorResponse
 
 	return driveradmin.ErrorResponse{}
 }
+
+func (d *DriverAdminLocal) ListVolumes(env dockerdriver.Env) driveradmin.ListVolumesResponse {
+	logger := env.Logger().Session("list-volumes")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	volumes := []driveradmin.VolumeInfo{}
+	for _, lister := range d.volumeListers {
+		volumes = append(volumes, lister.ListVolumes(env)...)
+	}
+
+	return driveradmin.ListVolumesResponse{Volumes: volumes}
+}
+
+func (d *DriverAdminLocal) Metrics(env dockerdriver.Env) driveradmin.MetricsResponse {
+	logger := env.Logger().Session("metrics")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	queues := []driveradmin.MountQueueMetrics{}
+	for _, provider := range d.metrics {
+		queues = append(queues, provider.MountQueueMetrics(env))
+	}
+
+	return driveradmin.MetricsResponse{MountQueues: queues}
+}
+
+func (d *DriverAdminLocal) RotateCredentials(env dockerdriver.Env, request driveradmin.RotateCredentialsRequest) driveradmin.RotateCredentialsResponse {
+	logger := env.Logger().Session("rotate-credentials")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	results := []driveradmin.RotateCredentialsResult{}
+	for _, rotator := range d.rotators {
+		rotated, err := rotator.RotateCredentials(env, request)
+		if err != nil {
+			return driveradmin.RotateCredentialsResponse{Err: err.Error()}
+		}
+		results = append(results, rotated...)
+	}
+
+	return driveradmin.RotateCredentialsResponse{Results: results}
+}
@@ -3,16 +3,24 @@ package driveradmin
 import (
 	"code.cloudfoundry.org/dockerdriver"
 	"github.com/tedsuo/rata"
+	"time"
 )
 
 const (
 	EvacuateRoute = "evacuate"
 	PingRoute     = "ping"
+	VolumesRoute  = "volumes"
+	MetricsRoute  = "metrics"
+
+	RotateCredentialsRoute = "rotate-credentials"
 )
 
 var Routes = rata.Routes{
 	{Path: "/evacuate", Method: "GET", Name: EvacuateRoute},
 	{Path: "/ping", Method: "GET", Name: PingRoute},
+	{Path: "/volumes", Method: "GET", Name: VolumesRoute},
+	{Path: "/metrics", Method: "GET", Name: MetricsRoute},
+	{Path: "/volumes/credentials", Method: "PUT", Name: RotateCredentialsRoute},
 }
 
 //go:generate counterfeiter -o ../nfsdriverfakes/fake_driver_admin.go . DriverAdmin
@@ -20,13 +28,103 @@ var Routes = rata.Routes{
 type DriverAdmin interface {
 	Evacuate(env dockerdriver.Env) ErrorResponse
 	Ping(env dockerdriver.Env) ErrorResponse
+	ListVolumes(env dockerdriver.Env) ListVolumesResponse
+	Metrics(env dockerdriver.Env) MetricsResponse
+	RotateCredentials(env dockerdriver.Env, request RotateCredentialsRequest) RotateCredentialsResponse
 }
 
 type ErrorResponse struct {
 	Err string
 }
 
+type ListVolumesResponse struct {
+	Volumes []VolumeInfo
+	Err     string
+}
+
+type VolumeInfo struct {
+	Name       string
+	Mountpoint string
+	MountCount int
+	Bucket     string
+	Prefix     string
+	Endpoint   string
+	ReadOnly   bool
+	Mounter    *MounterInfo `json:",omitempty"`
+	// LastMountError is the error of the last failed mount, until a mount
+	// succeeds or the error is too old to be retained.
+	LastMountError   string     `json:",omitempty"`
+	LastMountErrorAt *time.Time `json:",omitempty"`
+	// MountFailures counts the consecutive failed mounts.
+	MountFailures int `json:",omitempty"`
+}
+
+type MounterInfo struct {
+	Pid       int
+	StartedAt time.Time
+	Restarts  int
+	// Adopted is set on a mounter which survived a driver restart: it is
+	// restarted when it dies, but it cannot be controlled.
+	Adopted bool `json:",omitempty"`
+}
+
+type MetricsResponse struct {
+	MountQueues []MountQueueMetrics
+	Err         string
+}
+
+// MountQueueMetrics describe the mounts waiting for their turn to start a
+// mounter. Admitted and Abandoned count the mounts which got a slot, and
+// the ones whose request ended while queued.
+type MountQueueMetrics struct {
+	Limit            int
+	Running          int
+	Queued           int
+	Admitted         int64
+	Abandoned        int64
+	TotalWaitSeconds float64
+	MaxWaitSeconds   float64
+}
+
+// RotateCredentialsRequest gives new keys to volumes, named like the
+// volume 'Opts'.
+type RotateCredentialsRequest struct {
+	Volumes                []string `json:"volumes"`
+	AccessKeyId            string   `json:"access_key_id"`
+	SecretAccessKey        string   `json:"secret_access_key"`
+	SessionToken           string   `json:"session_token"`
+	SessionTokenExpiration string   `json:"session_token_expiration"`
+}
+
+type RotateCredentialsResponse struct {
+	Results []RotateCredentialsResult
+	Err     string
+}
+
+// RotateCredentialsResult tells whether a volume got its new keys, Mounted
+// is true when they were pushed into its running mounter.
+type RotateCredentialsResult struct {
+	Volume  string
+	Mounted bool
+	Err     string
+}
+
 //go:generate counterfeiter -o ../nfsdriverfakes/fake_drainable.go . Drainable
 type Drainable interface {
 	Drain(env dockerdriver.Env) error
 }
+
+//go:generate counterfeiter -o ../nfsdriverfakes/fake_volume_lister.go . VolumeLister
+type VolumeLister interface {
+	ListVolumes(env dockerdriver.Env) []VolumeInfo
+}
+
+//go:generate counterfeiter -o ../nfsdriverfakes/fake_metrics_provider.go . MetricsProvider
+type MetricsProvider interface {
+	MountQueueMetrics(env dockerdriver.Env) MountQueueMetrics
+}
+
+//go:generate counterfeiter -o ../nfsdriverfakes/fake_credentials_rotator.go . CredentialsRotator
+type CredentialsRotator interface {
+	RotateCredentials(env dockerdriver.Env, request RotateCredentialsRequest) ([]RotateCredentialsResult, error)
+}
@@ -12,7 +12,7 @@ require (
 	code.cloudfoundry.org/tlsconfig v0.0.0-20190710180242-462f72de1106 // indirect
 	code.cloudfoundry.org/volumedriver v0.0.0-20190624205815-521b41315311 // indirect
 	github.com/StackExchange/wmi v0.0.0-20190523213315-cbe66965904d // indirect
-	github.com/aws/aws-sdk-go v1.21.2 // indirect
+	github.com/aws/aws-sdk-go v1.21.2
 	github.com/bmizerany/pat v0.0.0-20170815010413-6226ea591a40 // indirect
 	github.com/cloudfoundry/volumedriver v0.0.0-20190624205815-521b41315311
 	github.com/go-ole/go-ole v1.2.4 // indirect
@@ -34,6 +34,7 @@ require (
 	github.com/tedsuo/ifrit v0.0.0-20180802180643-bea94bb476cc
 	github.com/tedsuo/rata v1.0.0
 	github.com/urfave/cli v1.20.0 // indirect
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/net v0.0.0-20190628185345-da137c7871d7 // indirect
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
 	launchpad.net/gocheck v0.0.0-20140225173054-000000000087 // indirect
@@ -0,0 +1,50 @@
+package s3driver
+
+import "sync"
+
+// volumeLocks serialise the operations on each volume, such as mounting or
+// removing it, while operations on different volumes run concurrently.
+//
+// volumesLock only guards the volumes map and the fields of its volumes for
+// the time of reading or updating them, it is never held across mounter or
+// process calls. A field is updated holding both the lock of its volume and
+// volumesLock, so that the holder of a volume lock may read its volume
+// without volumesLock.
+type volumeLocks struct {
+	locksLock sync.Mutex
+	locks     map[string]*volumeLock
+}
+
+type volumeLock struct {
+	sync.Mutex
+	// waiters counts the holder and the goroutines waiting for the lock,
+	// which is dropped once none is left.
+	waiters int
+}
+
+// lock takes the lock of a volume and returns the function releasing it.
+func (l *volumeLocks) lock(name string) func() {
+	l.locksLock.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*volumeLock{}
+	}
+	vl, ok := l.locks[name]
+	if !ok {
+		vl = &volumeLock{}
+		l.locks[name] = vl
+	}
+	vl.waiters++
+	l.locksLock.Unlock()
+
+	vl.Lock()
+	return func() {
+		vl.Unlock()
+
+		l.locksLock.Lock()
+		defer l.locksLock.Unlock()
+		vl.waiters--
+		if vl.waiters == 0 {
+			delete(l.locks, name)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package s3driver
+
+import (
+	"code.cloudfoundry.org/dockerdriver"
+	"code.cloudfoundry.org/dockerdriver/driverhttp"
+	"code.cloudfoundry.org/goshims/filepathshim"
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/goshims/timeshim"
+	"code.cloudfoundry.org/lager"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/orange-cloudfoundry/s3-volume-driver/params"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	// fakeMounterEnv makes the test binary act as an s3mounter
+	fakeMounterEnv = "S3DRIVER_TEST_FAKE_MOUNTER"
+	// fakeMounterGateEnv is a path: the mounter of slowVolume creates
+	// <path>.started, then waits for <path> before reporting its mount
+	fakeMounterGateEnv = "S3DRIVER_TEST_FAKE_MOUNTER_GATE"
+	slowVolume         = "slow"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakeMounterEnv) != "" {
+		fakeMounter()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// fakeMounter reports a successful mount, then stays up like a mounter
+// serving its volume until the driver closes its control socket.
+func fakeMounter() {
+	var p params.Mount
+	if err := json.NewDecoder(os.Stdin).Decode(&p); err != nil {
+		os.Exit(1)
+	}
+	control := os.NewFile(uintptr(params.ControlFd), "mounter-control")
+
+	if gate := os.Getenv(fakeMounterGateEnv); p.VolumeName == slowVolume && gate != "" {
+		ioutil.WriteFile(gate+".started", nil, 0600)
+		for {
+			if _, err := os.Stat(gate); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if err := json.NewEncoder(control).Encode(params.MountResult{}); err != nil {
+		os.Exit(1)
+	}
+	ioutil.ReadAll(control)
+	os.Exit(0)
+}
+
+type fakeInvoker struct{}
+
+// Invoke succeeds, 'mountpoint -q' reports every volume as mounted.
+func (fakeInvoker) Invoke(env dockerdriver.Env, executable string, args []string) ([]byte, error) {
+	return nil, nil
+}
+
+type fakeMountChecker struct{}
+
+func (fakeMountChecker) Exists(string) (bool, error) {
+	return false, nil
+}
+
+func (fakeMountChecker) List(*regexp.Regexp) ([]string, error) {
+	return nil, nil
+}
+
+type fakeOsHelper struct{}
+
+func (fakeOsHelper) Umask(mask int) int {
+	return 0
+}
+
+func newTestDriver(t *testing.T) (*S3Driver, dockerdriver.Env, string) {
+	dir, err := ioutil.TempDir("", "s3driver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mounterPath, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := lager.NewLogger("s3driver-test")
+	d := NewS3Driver(
+		logger,
+		&osshim.OsShim{},
+		&filepathshim.FilepathShim{},
+		&ioutilshim.IoutilShim{},
+		&timeshim.TimeShim{},
+		fakeMountChecker{},
+		filepath.Join(dir, "mounts"),
+		fakeOsHelper{},
+		fakeInvoker{},
+		mounterPath,
+		Config{MountTimeout: 30 * time.Second},
+	)
+	return d, driverhttp.NewHttpDriverEnv(logger, context.Background()), dir
+}
+
+func createVolume(d *S3Driver, env dockerdriver.Env, name string) dockerdriver.ErrorResponse {
+	return d.Create(env, dockerdriver.CreateRequest{
+		Name: name,
+		Opts: map[string]interface{}{
+			"bucket":            "bucket",
+			"access_key_id":     "access-key",
+			"secret_access_key": "secret-key",
+		},
+	})
+}
+
+// waitFor fails when done is not closed within timeout.
+func waitFor(t *testing.T, done <-chan struct{}, timeout time.Duration, what string) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+// TestSlowVolumeDoesNotBlockOthers mounts a volume whose mounter does not
+// report, and runs operations on other volumes meanwhile. Run it with -race
+// to check the volume fields are only updated holding the locks.
+func TestSlowVolumeDoesNotBlockOthers(t *testing.T) {
+	d, env, dir := newTestDriver(t)
+	defer os.RemoveAll(dir)
+
+	gate := filepath.Join(dir, "gate")
+	os.Setenv(fakeMounterEnv, "1")
+	os.Setenv(fakeMounterGateEnv, gate)
+	defer os.Unsetenv(fakeMounterEnv)
+	defer os.Unsetenv(fakeMounterGateEnv)
+
+	if response := createVolume(d, env, slowVolume); response.Err != "" {
+		t.Fatal(response.Err)
+	}
+
+	slowMounted := make(chan dockerdriver.MountResponse, 1)
+	go func() {
+		slowMounted <- d.Mount(env, dockerdriver.MountRequest{Name: slowVolume})
+	}()
+
+	started := make(chan struct{})
+	go func() {
+		for {
+			if _, err := os.Stat(gate + ".started"); err == nil {
+				close(started)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	waitFor(t, started, 10*time.Second, "the slow mounter to start")
+
+	// operations on the slow volume itself wait for its mount
+	slowCreated := make(chan struct{})
+	go func() {
+		if response := createVolume(d, env, slowVolume); response.Err != "" {
+			t.Error(response.Err)
+		}
+		close(slowCreated)
+	}()
+
+	others := make(chan struct{})
+	go func() {
+		defer close(others)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				name := fmt.Sprintf("volume-%d", i)
+				if response := createVolume(d, env, name); response.Err != "" {
+					t.Error(response.Err)
+					return
+				}
+				for j := 0; j < 2; j++ {
+					if response := d.Mount(env, dockerdriver.MountRequest{Name: name}); response.Err != "" {
+						t.Error(response.Err)
+						return
+					}
+				}
+				// the volume stays mounted, its count drops to 1
+				if response := d.Unmount(env, dockerdriver.UnmountRequest{Name: name}); response.Err != "" {
+					t.Error(response.Err)
+				}
+			}(i)
+
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				name := fmt.Sprintf("unmounted-%d", i)
+				if response := createVolume(d, env, name); response.Err != "" {
+					t.Error(response.Err)
+					return
+				}
+				if response := d.Remove(env, dockerdriver.RemoveRequest{Name: name}); response.Err != "" {
+					t.Error(response.Err)
+				}
+			}(i)
+
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				d.List(env)
+				d.ListVolumes(env)
+				d.Get(env, dockerdriver.GetRequest{Name: fmt.Sprintf("volume-%d", i)})
+				d.Path(env, dockerdriver.PathRequest{Name: fmt.Sprintf("volume-%d", i)})
+			}(i)
+		}
+		wg.Wait()
+	}()
+	waitFor(t, others, 20*time.Second, "operations on other volumes")
+
+	select {
+	case <-slowMounted:
+		t.Fatal("the slow volume mounted before its mounter reported")
+	case <-slowCreated:
+		t.Fatal("the slow volume was created again during its mount")
+	default:
+	}
+
+	if err := ioutil.WriteFile(gate, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case response := <-slowMounted:
+		if response.Err != "" {
+			t.Fatal(response.Err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the slow volume to mount")
+	}
+	waitFor(t, slowCreated, 10*time.Second, "the slow volume to be created again")
+
+	for _, volume := range d.ListVolumes(env) {
+		if volume.MountCount != 1 {
+			t.Errorf("volume %s has mount count %d, expected 1", volume.Name, volume.MountCount)
+		}
+	}
+	if len(d.ListVolumes(env)) != 9 {
+		t.Errorf("expected 9 volumes, got %d", len(d.ListVolumes(env)))
+	}
+}
@@ -5,15 +5,17 @@ import (
 	"code.cloudfoundry.org/dockerdriver"
 	"code.cloudfoundry.org/dockerdriver/driverhttp"
 	"code.cloudfoundry.org/lager"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/orange-cloudfoundry/s3-volume-driver/params"
 	"github.com/orange-cloudfoundry/s3-volume-driver/utils"
+	"net"
 	"os"
 	"os/exec"
-	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -27,103 +29,90 @@ func (d *S3Driver) Mount(env dockerdriver.Env, mountRequest dockerdriver.MountRe
 		return dockerdriver.MountResponse{Err: "Missing mandatory 'volume_name'"}
 	}
 
-	var doMount bool
-	var connInfo ConnectionInfo
-	var mountPath string
-	var volumeName string
+	unlock := d.volumeLocks.lock(mountRequest.Name)
+	defer unlock()
 
-	ret := func() dockerdriver.MountResponse {
+	mountPath := d.mountPath(driverhttp.EnvWithLogger(logger, env), mountRequest.Name)
 
-		d.volumesLock.Lock()
-		defer d.volumesLock.Unlock()
-
-		volume := d.volumes[mountRequest.Name]
-		if volume == nil {
-			return dockerdriver.MountResponse{Err: fmt.Sprintf("Volume '%s' must be created before being mounted", mountRequest.Name)}
-		}
-
-		mountPath = d.mountPath(driverhttp.EnvWithLogger(logger, env), volume.Name)
+	d.volumesLock.Lock()
+	volume := d.volumes[mountRequest.Name]
+	if volume == nil {
+		d.volumesLock.Unlock()
+		return dockerdriver.MountResponse{Err: fmt.Sprintf("Volume '%s' must be created before being mounted", mountRequest.Name)}
+	}
 
-		logger.Info("mounting-volume", lager.Data{"id": volume.Name, "mountpoint": mountPath})
-		logger.Info("mount-source", lager.Data{"bucket": volume.ConnectionInfo.Bucket})
+	logger.Info("mounting-volume", lager.Data{"id": volume.Name, "mountpoint": mountPath})
+	logger.Info("mount-source", lager.Data{"bucket": volume.ConnectionInfo.Bucket, "prefix": volume.ConnectionInfo.Prefix})
 
-		if volume.MountCount < 1 {
-			doMount = true
-			connInfo = volume.ConnectionInfo
-			volumeName = volume.Name
-		}
+	doMount := volume.MountCount < 1
+	volume.Mountpoint = mountPath
+	volume.MountCount++
+	if volume.mountFailure != nil && volume.mountFailure.expired(d.time.Now()) {
+		logger.Info("mount-failure-expired", lager.Data{"error": volume.mountFailure.err, "at": volume.mountFailure.at})
+		volume.mountFailure = nil
+	}
+	d.volumesLock.Unlock()
 
-		volume.Mountpoint = mountPath
-		volume.MountCount++
+	logger.Info("volume-ref-count-incremented", lager.Data{"name": volume.Name, "count": volume.MountCount})
 
-		logger.Info("volume-ref-count-incremented", lager.Data{"name": volume.Name, "count": volume.MountCount})
+	if err := d.persistVolume(driverhttp.EnvWithLogger(logger, env), volume); err != nil {
+		logger.Error("persist-state-failed", err)
+		return dockerdriver.MountResponse{Err: fmt.Sprintf("persist state failed when mounting: %s", err.Error())}
+	}
 
-		if err := d.persistState(driverhttp.EnvWithLogger(logger, env)); err != nil {
-			logger.Error("persist-state-failed", err)
-			return dockerdriver.MountResponse{Err: fmt.Sprintf("persist state failed when mounting: %s", err.Error())}
+	if !doMount {
+		// Check the volume to make sure it's still mounted before handing it
+		// out again. The supervisor may have respawned its mounter since the
+		// last failed mount.
+		if d.check(driverhttp.EnvWithLogger(logger, env), volume.Name, volume.Mountpoint) {
+			d.volumesLock.Lock()
+			defer d.volumesLock.Unlock()
+			volume.mountFailure = nil
+			return dockerdriver.MountResponse{Mountpoint: volume.Mountpoint}
 		}
 
-		return dockerdriver.MountResponse{Mountpoint: volume.Mountpoint}
-	}()
-
-	if ret.Err != "" {
-		return ret
+		// a volume whose last mount failed is mounted again once its backoff
+		// elapsed
+		if failure := volume.mountFailure; failure != nil {
+			if !failure.retryable(d.time.Now()) {
+				logger.Info("mount-failure-cached", lager.Data{"failures": failure.failures, "retry-after": failure.retryAfter})
+				return dockerdriver.MountResponse{Err: failure.err}
+			}
+			logger.Info("retry-failed-mount", lager.Data{"failures": failure.failures})
+		}
 	}
 
-	if doMount {
-		mountStartTime := d.time.Now()
+	mountStartTime := d.time.Now()
 
-		err := d.mount(driverhttp.EnvWithLogger(logger, env), connInfo, mountPath, volumeName)
+	err := d.mount(driverhttp.EnvWithLogger(logger, env), volume.ConnectionInfo, mountPath, volume.Name)
 
-		mountEndTime := d.time.Now()
-		mountDuration := mountEndTime.Sub(mountStartTime)
-		if mountDuration > 8*time.Second {
-			logger.Error("mount-duration-too-high", nil, lager.Data{"mount-duration-in-second": mountDuration / time.Second, "warning": "This may result in container creation failure!"})
-		}
+	mountEndTime := d.time.Now()
+	mountDuration := mountEndTime.Sub(mountStartTime)
+	if mountDuration > 8*time.Second {
+		logger.Error("mount-duration-too-high", nil, lager.Data{"mount-duration-in-second": mountDuration / time.Second, "warning": "This may result in container creation failure!"})
+	}
 
-		func() {
-			d.volumesLock.Lock()
-			defer d.volumesLock.Unlock()
+	if _, ok := err.(mountQueueError); ok {
+		// the mount did not get to run, the next one tries again
+		return dockerdriver.MountResponse{Err: err.Error()}
+	}
 
-			volume := d.volumes[mountRequest.Name]
-			if volume == nil {
-				ret = dockerdriver.MountResponse{Err: fmt.Sprintf("Volume '%s' not found", mountRequest.Name)}
-			} else if err != nil {
-				if _, ok := err.(dockerdriver.SafeError); ok {
-					errBytes, m_err := json.Marshal(err)
-					if m_err != nil {
-						logger.Error("failed-to-marshal-safeerror", m_err)
-						volume.mountError = err.Error()
-					}
-					volume.mountError = string(errBytes)
-				} else {
-					volume.mountError = err.Error()
-				}
-			}
-		}()
-
-	}
-
-	return func() dockerdriver.MountResponse {
-		d.volumesLock.Lock()
-		defer d.volumesLock.Unlock()
-
-		volume := d.volumes[mountRequest.Name]
-		if volume == nil {
-			return dockerdriver.MountResponse{Err: fmt.Sprintf("Volume '%s' not found", mountRequest.Name)}
-		} else if volume.mountError != "" {
-			return dockerdriver.MountResponse{Err: volume.mountError}
-		} else {
-			// Check the volume to make sure it's still mounted before handing it out again.
-			if !doMount && !d.check(driverhttp.EnvWithLogger(logger, env), volume.Name, volume.Mountpoint) {
-				if err := d.mount(driverhttp.EnvWithLogger(logger, env), volume.ConnectionInfo, mountPath, volume.Name); err != nil {
-					logger.Error("remount-volume-failed", err)
-					return dockerdriver.MountResponse{Err: fmt.Sprintf("Error remounting volume: %s", err.Error())}
-				}
-			}
-			return dockerdriver.MountResponse{Mountpoint: volume.Mountpoint}
+	d.volumesLock.Lock()
+	defer d.volumesLock.Unlock()
+	if err != nil {
+		message := errorText(logger, err)
+		if !doMount {
+			logger.Error("remount-volume-failed", err)
+			message = fmt.Sprintf("Error remounting volume: %s", err.Error())
 		}
-	}()
+		volume.mountFailure = nextMountFailure(volume.mountFailure, mountEndTime, message)
+		return dockerdriver.MountResponse{Err: volume.mountFailure.err}
+	}
+	volume.mountFailure = nil
+	if !doMount {
+		volume.RestoreError = ""
+	}
+	return dockerdriver.MountResponse{Mountpoint: volume.Mountpoint}
 }
 
 func (d *S3Driver) mountPath(env dockerdriver.Env, volumeId string) string {
@@ -144,7 +133,7 @@ func (d *S3Driver) mountPath(env dockerdriver.Env, volumeId string) string {
 }
 
 func (d *S3Driver) mount(env dockerdriver.Env, connInfo ConnectionInfo, mountPath, volumeName string) error {
-	logger := env.Logger().Session("mount", lager.Data{"bucket": connInfo.Bucket, "target": mountPath})
+	logger := env.Logger().Session("mount", lager.Data{"bucket": connInfo.Bucket, "target": mountPath, "readonly": connInfo.ReadOnly})
 	logger.Info("start")
 	defer logger.Info("end")
 
@@ -153,18 +142,26 @@ func (d *S3Driver) mount(env dockerdriver.Env, connInfo ConnectionInfo, mountPat
 		logger.Error("unable-to-extract-source", err)
 		return err
 	}
-	if connInfo.AccessKeyId == "" {
+	if !hasOwnCredentials(connInfo) && connInfo.AccessKeyId == "" {
 		err := errors.New("no access key id")
 		logger.Error("unable-to-extract-access-key-id", err)
 		return err
 	}
-	if connInfo.SecretAccessKey == "" {
+	if !hasOwnCredentials(connInfo) && connInfo.SecretAccessKey == "" {
 		err := errors.New("no secret access key")
 		logger.Error("unable-to-extract-secret-access-key", err)
 		return err
 	}
+	// the policy may have changed since the volume was created
+	if err := d.policy.check(connInfo); err != nil {
+		logger.Error("volume-breaks-policy", err)
+		return dockerdriver.SafeError{SafeDescription: err.Error()}
+	}
+	p, err := d.mountParams(logger, connInfo, volumeName)
+	if err != nil {
+		return err
+	}
 
-	uid, gid := utils.CurrentUserAndGroup()
 	if _, err := os.Stat(mountPath); os.IsNotExist(err) {
 		orig := d.osHelper.Umask(000)
 		defer d.osHelper.Umask(orig)
@@ -175,15 +172,75 @@ func (d *S3Driver) mount(env dockerdriver.Env, connInfo ConnectionInfo, mountPat
 			return err
 		}
 
-		err = d.os.Chown(mountPath, uid, gid)
+		err = d.os.Chown(mountPath, p.Uid, p.Gid)
 		if err != nil {
 			logger.Error("chown-mountdir-failed", err)
 			return err
 		}
 	}
 
-	return d.startMounter(volumeName, params.Mount{
-		MountPoint:   mountPath,
+	wait, err := d.mountQueue.acquire(env.Context())
+	if err != nil {
+		logger.Error("mount-not-admitted", err, lager.Data{"waited": wait.String()})
+		return err
+	}
+	defer d.mountQueue.release()
+	if wait > 0 {
+		logger.Info("mount-admitted", lager.Data{"waited": wait.String()})
+	}
+
+	p.MountPoint = mountPath
+	p.CacheDir, p.CacheSize = d.reserveCache(logger, volumeName, connInfo)
+
+	err = d.startMounter(env, volumeName, p)
+	if err != nil && p.CacheDir != "" {
+		d.cache.release(volumeName)
+	}
+	return err
+}
+
+// mountParams are the mounter parameters of a volume, but for its
+// mountpoint and cache.
+func (d *S3Driver) mountParams(logger lager.Logger, connInfo ConnectionInfo, volumeName string) (params.Mount, error) {
+	var expiration time.Time
+	if connInfo.SessionTokenExpiration != "" {
+		parsed, err := parseExpiration(connInfo.SessionTokenExpiration)
+		if err != nil {
+			logger.Error("invalid-session-token-expiration", err)
+			return params.Mount{}, err
+		}
+		expiration = parsed
+		if d.credentialProcess == "" && !expiration.After(time.Now()) {
+			err := dockerdriver.SafeError{SafeDescription: "session token expired and no credential process is configured to refresh it"}
+			logger.Error("session-token-expired", err)
+			return params.Mount{}, err
+		}
+	}
+
+	uid, gid := utils.CurrentUserAndGroup()
+	if connInfo.Uid != nil {
+		uid = *connInfo.Uid
+	}
+	if connInfo.Gid != nil {
+		gid = *connInfo.Gid
+	}
+	dirMode, err := parseMode("dir_mode", connInfo.DirMode)
+	if err != nil {
+		logger.Error("invalid-dir-mode", err)
+		return params.Mount{}, err
+	}
+	fileMode, err := parseMode("file_mode", connInfo.FileMode)
+	if err != nil {
+		logger.Error("invalid-file-mode", err)
+		return params.Mount{}, err
+	}
+	tuning, err := resolveTuning(connInfo, d.defaultTuning)
+	if err != nil {
+		logger.Error("invalid-tuning", err)
+		return params.Mount{}, err
+	}
+
+	return params.Mount{
 		MountOptions: connInfo.MountOptions,
 		Bucket:       connInfo.Bucket,
 
@@ -202,35 +259,216 @@ func (d *S3Driver) mount(env dockerdriver.Env, connInfo ConnectionInfo, mountPat
 		ACL:             connInfo.ACL,
 		Subdomain:       connInfo.Subdomain,
 		KMSKeyID:        connInfo.KMSKeyID,
-	})
+		SSECKey:         connInfo.SSECKey,
+		Prefix:          connInfo.Prefix,
+		CreatePrefix:    connInfo.CreatePrefix,
+		ReadOnly:        connInfo.ReadOnly,
+		DirMode:         dirMode,
+		FileMode:        fileMode,
+		StatCacheTTL:    tuning.StatCacheTTL,
+		TypeCacheTTL:    tuning.TypeCacheTTL,
+		HTTPTimeout:     tuning.HTTPTimeout,
+		Cheap:           tuning.Cheap,
+		ExplicitDir:     tuning.ExplicitDir,
+		CatfsPath:       d.catfsPath,
+
+		SessionToken:           connInfo.SessionToken,
+		SessionTokenExpiration: expiration,
+		CredentialProcess:      d.credentialProcess,
+		VolumeName:             volumeName,
+
+		RoleARN:         connInfo.RoleARN,
+		ExternalID:      connInfo.ExternalID,
+		RoleSessionName: connInfo.RoleSessionName,
+		STSEndpoint:     d.stsEndpoint,
+		Anonymous:       connInfo.Anonymous,
+		CredentialsFile: d.credentialsFile,
+		Profile:         connInfo.Profile,
+
+		CACert:             connInfo.CACert,
+		TrustedCADir:       d.trustedCADir,
+		InsecureSkipVerify: connInfo.InsecureSkipVerify && d.allowInsecureSkipVerify,
+
+		HTTPProxy: connInfo.HTTPProxy,
+		NoProxy:   connInfo.NoProxy,
+	}, nil
 }
 
-func (d *S3Driver) startMounter(volumeName string, p params.Mount) error {
+// startMounter spawns the s3mounter of a volume and hands it over to the
+// supervisor once the bucket is mounted.
+func (d *S3Driver) startMounter(env dockerdriver.Env, volumeName string, p params.Mount) error {
+	proc, err := d.spawnMounter(env, volumeName, p)
+	if err != nil {
+		return err
+	}
+	d.supervisor.supervise(proc)
+	return nil
+}
+
+// spawnMounter starts an s3mounter and waits for the mount result it sends
+// back on a socket dedicated to this mounter. The mounter is killed when the
+// request context is done or when the mount timeout expires first.
+func (d *S3Driver) spawnMounter(env dockerdriver.Env, volumeName string, p params.Mount) (*mounterProcess, error) {
+	logger := env.Logger().Session("spawn-mounter", lager.Data{"volume": volumeName})
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create mounter control socket: %s", err.Error())
+	}
+	controlFile := os.NewFile(uintptr(fds[0]), "mounter-control")
+	mounterControl := os.NewFile(uintptr(fds[1]), "mounter-control")
+	// a net.Conn supports deadlines on control requests
+	control, err := net.FileConn(controlFile)
+	controlFile.Close()
+	if err != nil {
+		mounterControl.Close()
+		return nil, fmt.Errorf("unable to create mounter control socket: %s", err.Error())
+	}
+
+	cmd := d.mounterCommand(volumeName, p, mounterControl)
+	err = cmd.Start()
+	mounterControl.Close()
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	proc := newMounterProcess(volumeName, p, cmd, control, d.time.Now())
+
+	result, err := d.waitMounterResult(driverhttp.EnvWithLogger(logger, env), proc.pid, proc.decoder, "mount")
+	if err != nil {
+		d.abortMounter(env, proc)
+		if err == errMounterResultMissing {
+			return nil, fmt.Errorf("%s: %s", err.Error(), proc.exitStatus)
+		}
+		return nil, err
+	}
+	if result.Error != nil {
+		return nil, dockerdriver.SafeError{SafeDescription: result.Error.Message}
+	}
+	return proc, nil
+}
+
+var errMounterResultMissing = errors.New("mounter exited without reporting a result")
+
+// waitMounterResult decodes the result a mounter reports on decoder. The
+// mounter closes its end when exiting, so this never blocks on a mounter
+// which died without reporting: errMounterResultMissing is returned then. A
+// mounter which does not report within the mount timeout, or before the
+// request is cancelled, is killed along with its process group.
+func (d *S3Driver) waitMounterResult(env dockerdriver.Env, pid int, decoder *json.Decoder, operation string) (params.MountResult, error) {
+	logger := env.Logger()
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
+	results := make(chan error, 1)
+	var result params.MountResult
+	go func() {
+		results <- decoder.Decode(&result)
+	}()
+
+	timeout := time.NewTimer(d.mountTimeout)
+	defer timeout.Stop()
+
+	select {
+	case err := <-results:
+		if err != nil {
+			logger.Error("mounter-result-missing", err)
+			return params.MountResult{}, errMounterResultMissing
+		}
+		return result, nil
+	case <-timeout.C:
+		logger.Error("mounter-timed-out", nil, lager.Data{"timeout": d.mountTimeout.String()})
+		syscall.Kill(-pid, syscall.SIGKILL)
+		return params.MountResult{}, dockerdriver.SafeError{SafeDescription: fmt.Sprintf("%s timed out after %s", operation, d.mountTimeout)}
+	case <-env.Context().Done():
+		logger.Error("mounter-cancelled", env.Context().Err())
+		syscall.Kill(-pid, syscall.SIGKILL)
+		return params.MountResult{}, dockerdriver.SafeError{SafeDescription: fmt.Sprintf("%s cancelled: %s", operation, env.Context().Err())}
+	}
+}
+
+// mounterCommand is an s3mounter given p, in its own process group so that
+// it is killed along with its children. control becomes params.ControlFd in
+// the mounter.
+func (d *S3Driver) mounterCommand(volumeName string, p params.Mount, control *os.File) *exec.Cmd {
 	cmd := exec.Command(d.mounterPath, volumeName)
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Setpgid: true,
 	}
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{control}
 
 	b, _ := json.Marshal(p)
 	cmd.Stdin = bytes.NewBuffer(b)
 
-	cmd.Env = os.Environ()
-	err := cmd.Start()
-	if err != nil {
-		return err
+	cmd.Env = mounterEnv(os.Environ(), p)
+	return cmd
+}
+
+// abortMounter kills a mounter which did not finish mounting and removes
+// what it may have left on the mountpoint.
+func (d *S3Driver) abortMounter(env dockerdriver.Env, proc *mounterProcess) {
+	logger := env.Logger().Session("abort-mounter", lager.Data{"pid": proc.pid, "mountpoint": proc.params.MountPoint})
+
+	// a mounter which timed out was killed already, and may be reaped
+	if err := syscall.Kill(-proc.pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		logger.Error("kill-mounter-failed", err)
+	}
+	<-proc.exited
+
+	// the request context may be the reason of the abort, cleanup must not
+	// depend on it
+	env = driverhttp.EnvWithContext(context.Background(), env)
+
+	if err := d.unmountStaleMounts(env, proc.params.MountPoint, proc.params.CacheDir); err != nil {
+		logger.Error("unmount-failed", err)
 	}
+	if err := d.os.Remove(proc.params.MountPoint); err != nil && !os.IsNotExist(err) {
+		logger.Error("remove-mountpoint-failed", err)
+	}
+}
 
-	sig := <-sigs
-	switch sig {
-	case syscall.SIGUSR2:
-		return fmt.Errorf("something went wrong with mounter")
-	case syscall.SIGUSR1:
-		return nil
+var (
+	httpProxyVars = []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy"}
+	noProxyVars   = []string{"NO_PROXY", "no_proxy"}
+)
+
+// mounterEnv is the driver environment with the proxy settings of the
+// volume, which apply to its mounter only.
+func mounterEnv(environ []string, p params.Mount) []string {
+	var overridden []string
+	if p.HTTPProxy != "" {
+		overridden = append(overridden, httpProxyVars...)
 	}
-	return nil
+	if p.NoProxy != "" {
+		overridden = append(overridden, noProxyVars...)
+	}
+
+	env := []string{}
+	for _, variable := range environ {
+		name := strings.SplitN(variable, "=", 2)[0]
+		if !contains(overridden, name) {
+			env = append(env, variable)
+		}
+	}
+
+	if p.HTTPProxy != "" {
+		for _, name := range httpProxyVars {
+			env = append(env, name+"="+p.HTTPProxy)
+		}
+	}
+	if p.NoProxy != "" {
+		for _, name := range noProxyVars {
+			env = append(env, name+"="+p.NoProxy)
+		}
+	}
+	return env
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,108 @@
+package s3driver
+
+import (
+	"code.cloudfoundry.org/dockerdriver"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type failingInvoker struct{}
+
+// Invoke fails, 'mountpoint -q' reports every volume as not mounted.
+func (failingInvoker) Invoke(env dockerdriver.Env, executable string, args []string) ([]byte, error) {
+	return nil, errors.New("not a mountpoint")
+}
+
+// TestMountAfterRespawn hands out a volume whose mounter was respawned
+// since its last failed mount, instead of the failure or a second mounter.
+func TestMountAfterRespawn(t *testing.T) {
+	d, env, dir := newTestDriver(t)
+	defer os.RemoveAll(dir)
+
+	if response := createVolume(d, env, "volume"); response.Err != "" {
+		t.Fatal(response.Err)
+	}
+	now := time.Now()
+	d.volumesLock.Lock()
+	volume := d.volumes["volume"]
+	volume.MountCount = 1
+	volume.mountFailure = &mountFailure{err: "mount failed", at: now, failures: 3, retryAfter: now.Add(time.Hour)}
+	d.volumesLock.Unlock()
+
+	// the mountpoint is not served, the failure is still cached
+	d.invoker = failingInvoker{}
+	if response := d.Mount(env, dockerdriver.MountRequest{Name: "volume"}); response.Err != "mount failed" {
+		t.Fatalf("expected the cached failure, got %+v", response)
+	}
+
+	// the supervisor respawned the mounter meanwhile
+	d.invoker = fakeInvoker{}
+	if response := d.Mount(env, dockerdriver.MountRequest{Name: "volume"}); response.Err != "" {
+		t.Fatal(response.Err)
+	}
+	d.volumesLock.RLock()
+	defer d.volumesLock.RUnlock()
+	if volume.mountFailure != nil {
+		t.Error("the mount failure was not cleared")
+	}
+	if _, ok := d.supervisor.process("volume"); ok {
+		t.Error("another mounter was started")
+	}
+}
+
+// startWithResultPipe starts a command in its own process group, with the
+// write end of a pipe it never writes to, like a mounter not reporting.
+func startWithResultPipe(t *testing.T, name string, args ...string) (*exec.Cmd, *json.Decoder) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		t.Skipf("%s is not available", name)
+	}
+	resultReader, resultWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(path, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.ExtraFiles = []*os.File{resultWriter}
+	err = cmd.Start()
+	resultWriter.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cmd, json.NewDecoder(resultReader)
+}
+
+func TestWaitMounterResultKillsSlowMounter(t *testing.T) {
+	d, env, dir := newTestDriver(t)
+	defer os.RemoveAll(dir)
+	d.mountTimeout = 100 * time.Millisecond
+
+	cmd, decoder := startWithResultPipe(t, "sleep", "60")
+	_, err := d.waitMounterResult(env, cmd.Process.Pid, decoder, "mount")
+	if safeErr, ok := err.(dockerdriver.SafeError); !ok || safeErr.SafeDescription != "mount timed out after 100ms" {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	waitFor(t, exited, 10*time.Second, "the mounter to be killed")
+}
+
+func TestWaitMounterResultMissing(t *testing.T) {
+	d, env, dir := newTestDriver(t)
+	defer os.RemoveAll(dir)
+
+	cmd, decoder := startWithResultPipe(t, "true")
+	defer cmd.Wait()
+	if _, err := d.waitMounterResult(env, cmd.Process.Pid, decoder, "mount"); err != errMounterResultMissing {
+		t.Errorf("expected errMounterResultMissing, got %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package s3driver
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"github.com/orange-cloudfoundry/s3-volume-driver/driveradmin"
+	"sync"
+	"time"
+)
+
+// mountQueue bounds the number of mounters starting at once, so that a cell
+// coming back does not hit its endpoints with every volume at the same time.
+// Mounts beyond the limit wait in arrival order.
+type mountQueue struct {
+	lock    sync.Mutex
+	limit   int
+	running int
+	// waiters holds a channel per queued mount, closed when it is given the
+	// slot of a finished one
+	waiters *list.List
+
+	admitted  int64
+	abandoned int64
+	totalWait time.Duration
+	maxWait   time.Duration
+}
+
+// mountQueueError is returned by mounts which gave up waiting for their
+// turn, they did not fail to mount.
+type mountQueueError struct {
+	err error
+}
+
+func (e mountQueueError) Error() string {
+	return fmt.Sprintf("gave up waiting for a mount slot: %s", e.err.Error())
+}
+
+// newMountQueue returns a queue letting limit mounts run together, a limit
+// of 0 or less does not bound them.
+func newMountQueue(limit int) *mountQueue {
+	return &mountQueue{
+		limit:   limit,
+		waiters: list.New(),
+	}
+}
+
+// acquire waits for a mount slot until ctx is done, and returns how long it
+// waited. The slot is given back with release.
+func (q *mountQueue) acquire(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+
+	q.lock.Lock()
+	if q.limit <= 0 || (q.running < q.limit && q.waiters.Len() == 0) {
+		q.running++
+		q.admit(0)
+		q.lock.Unlock()
+		return 0, nil
+	}
+	ready := make(chan struct{})
+	waiter := q.waiters.PushBack(ready)
+	q.lock.Unlock()
+
+	select {
+	case <-ready:
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		wait := time.Since(start)
+		q.admit(wait)
+		return wait, nil
+	case <-ctx.Done():
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		select {
+		case <-ready:
+			// the slot was handed over meanwhile, pass it on
+			q.releaseLocked()
+		default:
+			q.waiters.Remove(waiter)
+		}
+		q.abandoned++
+		return time.Since(start), mountQueueError{err: ctx.Err()}
+	}
+}
+
+func (q *mountQueue) release() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.releaseLocked()
+}
+
+// releaseLocked hands the slot over to the first queued mount, the running
+// count is unchanged then.
+func (q *mountQueue) releaseLocked() {
+	if first := q.waiters.Front(); first != nil {
+		q.waiters.Remove(first)
+		close(first.Value.(chan struct{}))
+		return
+	}
+	q.running--
+}
+
+func (q *mountQueue) admit(wait time.Duration) {
+	q.admitted++
+	q.totalWait += wait
+	if wait > q.maxWait {
+		q.maxWait = wait
+	}
+}
+
+func (q *mountQueue) metrics() driveradmin.MountQueueMetrics {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return driveradmin.MountQueueMetrics{
+		Limit:            q.limit,
+		Running:          q.running,
+		Queued:           q.waiters.Len(),
+		Admitted:         q.admitted,
+		Abandoned:        q.abandoned,
+		TotalWaitSeconds: q.totalWait.Seconds(),
+		MaxWaitSeconds:   q.maxWait.Seconds(),
+	}
+}
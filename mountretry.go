@@ -0,0 +1,54 @@
+package s3driver
+
+import "time"
+
+const (
+	mountRetryMinBackoff = 1 * time.Second
+	mountRetryMaxBackoff = 2 * time.Minute
+	// a mount failure older than this is forgotten: the next mount retries
+	// right away and its backoff starts over
+	mountFailureMaxAge = 10 * time.Minute
+)
+
+// mountFailure is the last failed mount of a volume. Mounts fail fast with
+// its error until its backoff elapsed, and a successful mount clears it.
+type mountFailure struct {
+	err string
+	at  time.Time
+	// failures counts the consecutive failed mounts
+	failures   int
+	retryAfter time.Time
+}
+
+// nextMountFailure records a failed mount following previous, nil when the
+// volume did mount before. The first failure is retried by the next mount
+// right away, then the backoff doubles up to mountRetryMaxBackoff.
+func nextMountFailure(previous *mountFailure, now time.Time, err string) *mountFailure {
+	failures := 1
+	if previous != nil {
+		failures = previous.failures + 1
+	}
+
+	var backoff time.Duration
+	if failures > 1 {
+		backoff = mountRetryMaxBackoff
+		if shift := uint(failures - 2); shift < 32 && mountRetryMinBackoff<<shift < mountRetryMaxBackoff {
+			backoff = mountRetryMinBackoff << shift
+		}
+	}
+
+	return &mountFailure{
+		err:        err,
+		at:         now,
+		failures:   failures,
+		retryAfter: now.Add(backoff),
+	}
+}
+
+func (f *mountFailure) expired(now time.Time) bool {
+	return now.Sub(f.at) > mountFailureMaxAge
+}
+
+func (f *mountFailure) retryable(now time.Time) bool {
+	return !now.Before(f.retryAfter)
+}
@@ -0,0 +1,23 @@
+package params
+
+import "time"
+
+// ControlRequest is sent by the driver to a mounter once its bucket is
+// mounted, on the control socket.
+type ControlRequest struct {
+	RotateCredentials *Credentials `json:"rotate_credentials,omitempty"`
+}
+
+// ControlResponse answers a ControlRequest, Error is safe to show to users.
+type ControlResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+// Credentials replace the keys of a mounted volume.
+type Credentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	// SessionTokenExpiration is zero when the expiry is unknown
+	SessionTokenExpiration time.Time
+}
@@ -1,5 +1,10 @@
 package params
 
+import (
+	"os"
+	"time"
+)
+
 type Mount struct {
 	Uid             int
 	Gid             int
@@ -18,4 +23,37 @@ type Mount struct {
 	KMSKeyID        string
 	ACL             string
 	Subdomain       bool
+	Prefix          string
+	CreatePrefix    bool
+	ReadOnly        bool
+	DirMode         os.FileMode
+	FileMode        os.FileMode
+	StatCacheTTL    time.Duration
+	TypeCacheTTL    time.Duration
+	HTTPTimeout     time.Duration
+	Cheap           bool
+	ExplicitDir     bool
+	CacheDir        string
+	CacheSize       int64
+	CatfsPath       string
+	SessionToken    string
+	// SessionTokenExpiration is zero when the expiry is unknown
+	SessionTokenExpiration time.Time
+	CredentialProcess      string
+	VolumeName             string
+	RoleARN                string
+	ExternalID             string
+	RoleSessionName        string
+	STSEndpoint            string
+	Anonymous              bool
+	CredentialsFile        string
+	Profile                string
+	CACert                 string
+	TrustedCADir           string
+	InsecureSkipVerify     bool
+	HTTPProxy              string
+	NoProxy                string
+	SSECKey                string
+	// Preflight only checks the bucket can be accessed, nothing is mounted
+	Preflight bool
 }
@@ -0,0 +1,29 @@
+package params
+
+// ControlFd is the file descriptor on which the mounter finds its end of the
+// socket shared with the driver.
+const ControlFd = 3
+
+// Error types reported by the mounter.
+const (
+	ErrInvalidParams = "invalid-params"
+	ErrMountPoint    = "mountpoint"
+	ErrBucketAccess  = "bucket-access"
+	ErrMountFailed   = "mount-failed"
+	ErrAccessDenied  = "access-denied"
+	ErrNoSuchBucket  = "no-such-bucket"
+	ErrWrongRegion   = "wrong-region"
+)
+
+// MountResult is sent by the mounter to the driver once the bucket is
+// mounted, or once mounting it failed. A preflight reports the same way.
+type MountResult struct {
+	Error *MountError `json:"error,omitempty"`
+}
+
+// MountError describes why a mount failed. Message is safe to show to users,
+// details about the failure only go to the mounter logs.
+type MountError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
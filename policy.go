@@ -0,0 +1,128 @@
+package s3driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// defaultEndpointHost stands for AWS S3 when a volume gives no endpoint.
+const defaultEndpointHost = "s3.amazonaws.com"
+
+// Policy restricts what volumes may ask for. Each empty list allows
+// anything.
+type Policy struct {
+	// Endpoints are host globs such as '*.s3.amazonaws.com' or
+	// 'minio.internal:9000', matched with or without the endpoint port.
+	Endpoints []string `json:"endpoints"`
+	// Buckets are regular expressions matched against the whole bucket name.
+	Buckets        []string `json:"buckets"`
+	StorageClasses []string `json:"storage_classes"`
+	// MountOptions are the FUSE options volumes may set.
+	MountOptions []string `json:"mount_options"`
+
+	buckets []*regexp.Regexp
+}
+
+// LoadPolicy reads a JSON policy file.
+func LoadPolicy(policyFile string) (*Policy, error) {
+	content, err := ioutil.ReadFile(policyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &Policy{}
+	if err := json.Unmarshal(content, policy); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %s", policyFile, err.Error())
+	}
+
+	for _, endpoint := range policy.Endpoints {
+		if _, err := path.Match(endpoint, ""); err != nil {
+			return nil, fmt.Errorf("invalid endpoint pattern '%s' in policy file: %s", endpoint, err.Error())
+		}
+	}
+	for _, bucket := range policy.Buckets {
+		re, err := regexp.Compile("^(?:" + bucket + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket pattern '%s' in policy file: %s", bucket, err.Error())
+		}
+		policy.buckets = append(policy.buckets, re)
+	}
+	return policy, nil
+}
+
+// check returns a user safe error when a volume breaks the policy. A nil
+// policy allows anything.
+func (p *Policy) check(connInfo ConnectionInfo) error {
+	if p == nil {
+		return nil
+	}
+
+	if len(p.Endpoints) > 0 && !p.allowsEndpoint(connInfo.Endpoint) {
+		return fmt.Errorf("'endpoint' '%s' is not allowed by the driver policy", connInfo.Endpoint)
+	}
+	if len(p.buckets) > 0 && !p.allowsBucket(connInfo.Bucket) {
+		return fmt.Errorf("'bucket' '%s' is not allowed by the driver policy", connInfo.Bucket)
+	}
+	if len(p.StorageClasses) > 0 && connInfo.StorageClass != "" && !containsFold(p.StorageClasses, connInfo.StorageClass) {
+		return fmt.Errorf("'storage_class' '%s' is not allowed by the driver policy", connInfo.StorageClass)
+	}
+	for option, value := range connInfo.MountOptions {
+		if len(p.MountOptions) > 0 && !contains(p.MountOptions, option) {
+			return fmt.Errorf("'mount_options' '%s' is not allowed by the driver policy", option)
+		}
+		// values are passed unescaped to fuse, they could add options
+		if strings.ContainsAny(value, `,\`) {
+			return fmt.Errorf("'mount_options' '%s' value cannot contain ',' or '\\'", option)
+		}
+	}
+	return nil
+}
+
+func (p *Policy) allowsEndpoint(endpoint string) bool {
+	host := defaultEndpointHost
+	if endpoint != "" {
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "https://" + endpoint
+		}
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return false
+		}
+		host = strings.ToLower(u.Host)
+	}
+	hostname := strings.Split(host, ":")[0]
+
+	for _, pattern := range p.Endpoints {
+		pattern = strings.ToLower(pattern)
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, hostname); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) allowsBucket(bucket string) bool {
+	for _, re := range p.buckets {
+		if re.MatchString(bucket) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
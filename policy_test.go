@@ -0,0 +1,49 @@
+package s3driver
+
+import (
+	"code.cloudfoundry.org/dockerdriver"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestPolicyRejectsInjectedMountOptions(t *testing.T) {
+	policy := &Policy{MountOptions: []string{"uid", "gid"}}
+
+	for _, value := range []string{"0,allow_root", `0\,allow_root`, `0\`} {
+		connInfo := ConnectionInfo{MountOptions: map[string]string{"uid": value}}
+		if err := policy.check(connInfo); err == nil {
+			t.Errorf("mount option value %q was allowed", value)
+		}
+	}
+
+	connInfo := ConnectionInfo{MountOptions: map[string]string{"uid": "1000", "gid": ""}}
+	if err := policy.check(connInfo); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestCreateBreakingPolicy tells the user why the volume was rejected.
+func TestCreateBreakingPolicy(t *testing.T) {
+	d, env, dir := newTestDriver(t)
+	defer os.RemoveAll(dir)
+	d.policy = &Policy{MountOptions: []string{"uid"}}
+
+	response := d.Create(env, dockerdriver.CreateRequest{
+		Name: "volume",
+		Opts: map[string]interface{}{
+			"bucket":            "bucket",
+			"access_key_id":     "access-key",
+			"secret_access_key": "secret-key",
+			"mount_options":     map[string]interface{}{"allow_root": ""},
+		},
+	})
+
+	var safeErr dockerdriver.SafeError
+	if err := json.Unmarshal([]byte(response.Err), &safeErr); err != nil {
+		t.Fatalf("expected a safe error, got %q", response.Err)
+	}
+	if safeErr.SafeDescription != "'mount_options' 'allow_root' is not allowed by the driver policy" {
+		t.Errorf("unexpected error %q", safeErr.SafeDescription)
+	}
+}
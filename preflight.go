@@ -0,0 +1,66 @@
+package s3driver
+
+import (
+	"code.cloudfoundry.org/dockerdriver"
+	"code.cloudfoundry.org/dockerdriver/driverhttp"
+	"code.cloudfoundry.org/lager"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// preflight has a mounter check the bucket and prefix of a volume can be
+// accessed with its credentials, so that mistakes in volume parameters are
+// reported on create instead of on the first mount.
+func (d *S3Driver) preflight(env dockerdriver.Env, volumeName string, connInfo ConnectionInfo) error {
+	logger := env.Logger().Session("preflight", lager.Data{"volume": volumeName, "bucket": connInfo.Bucket, "prefix": connInfo.Prefix})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	p, err := d.mountParams(logger, connInfo, volumeName)
+	if err != nil {
+		return err
+	}
+	p.Preflight = true
+
+	resultReader, resultWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer resultReader.Close()
+
+	cmd := d.mounterCommand(volumeName, p, resultWriter)
+	err = cmd.Start()
+	resultWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	result, err := d.waitMounterResult(driverhttp.EnvWithLogger(logger, env), cmd.Process.Pid, json.NewDecoder(resultReader), "bucket validation")
+	cmd.Wait()
+	if err == errMounterResultMissing {
+		return fmt.Errorf("%s: %s", err.Error(), cmd.ProcessState.String())
+	}
+	if err != nil {
+		return err
+	}
+	if result.Error != nil {
+		logger.Info("preflight-failed", lager.Data{"type": result.Error.Type, "message": result.Error.Message})
+		return dockerdriver.SafeError{SafeDescription: result.Error.Message}
+	}
+	return nil
+}
+
+// errorText is how an error goes back to the volume manager, safe errors
+// are sent as JSON so they can be told apart.
+func errorText(logger lager.Logger, err error) string {
+	if _, ok := err.(dockerdriver.SafeError); ok {
+		errBytes, mErr := json.Marshal(err)
+		if mErr != nil {
+			logger.Error("failed-to-marshal-safeerror", mErr)
+			return err.Error()
+		}
+		return string(errBytes)
+	}
+	return err.Error()
+}
@@ -0,0 +1,123 @@
+package s3driver
+
+import (
+	"code.cloudfoundry.org/dockerdriver"
+	"code.cloudfoundry.org/dockerdriver/driverhttp"
+	"code.cloudfoundry.org/lager"
+	"errors"
+	"fmt"
+	"github.com/orange-cloudfoundry/s3-volume-driver/driveradmin"
+	"github.com/orange-cloudfoundry/s3-volume-driver/params"
+	"time"
+)
+
+// RotateCredentials replaces the keys of volumes. Mounted volumes get them
+// pushed into their running mounter, which checks them against the bucket
+// before switching, so they are used without remounting.
+func (d *S3Driver) RotateCredentials(env dockerdriver.Env, request driveradmin.RotateCredentialsRequest) ([]driveradmin.RotateCredentialsResult, error) {
+	logger := env.Logger().Session("rotate-credentials", lager.Data{"volumes": request.Volumes})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if len(request.Volumes) == 0 {
+		return nil, errors.New("Missing mandatory 'volumes' field")
+	}
+	if request.AccessKeyId == "" {
+		return nil, errors.New("Missing mandatory 'access_key_id' field")
+	}
+	if request.SecretAccessKey == "" {
+		return nil, errors.New("Missing mandatory 'secret_access_key' field")
+	}
+	var expiration time.Time
+	if request.SessionTokenExpiration != "" {
+		if request.SessionToken == "" {
+			return nil, errors.New("'session_token_expiration' requires a 'session_token'")
+		}
+		var err error
+		expiration, err = parseExpiration(request.SessionTokenExpiration)
+		if err != nil {
+			return nil, err
+		}
+	}
+	creds := params.Credentials{
+		AccessKeyId:            request.AccessKeyId,
+		SecretAccessKey:        request.SecretAccessKey,
+		SessionToken:           request.SessionToken,
+		SessionTokenExpiration: expiration,
+	}
+
+	results := []driveradmin.RotateCredentialsResult{}
+	for _, volumeName := range request.Volumes {
+		result := driveradmin.RotateCredentialsResult{Volume: volumeName}
+		if err := d.rotateVolumeCredentials(driverhttp.EnvWithLogger(logger, env), volumeName, creds, request, &result); err != nil {
+			logger.Error("rotate-volume-credentials-failed", err, lager.Data{"volume": volumeName})
+			result.Err = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (d *S3Driver) rotateVolumeCredentials(env dockerdriver.Env, volumeName string, creds params.Credentials, request driveradmin.RotateCredentialsRequest, result *driveradmin.RotateCredentialsResult) error {
+	logger := env.Logger()
+
+	unlock := d.volumeLocks.lock(volumeName)
+	defer unlock()
+
+	d.volumesLock.RLock()
+	volume, ok := d.volumes[volumeName]
+	var connInfo ConnectionInfo
+	var sealed bool
+	var mountCount int
+	if ok {
+		connInfo = volume.ConnectionInfo
+		sealed = volume.SealedCredentials != ""
+		mountCount = volume.MountCount
+	}
+	d.volumesLock.RUnlock()
+
+	if !ok {
+		return errors.New("volume not found")
+	}
+	if sealed {
+		// its other secrets would be lost with the sealed credentials
+		return errors.New("volume credentials could not be unsealed, it must be created again")
+	}
+	if connInfo.Anonymous {
+		return errors.New("volume is anonymous, it has no credentials")
+	}
+	if connInfo.RoleARN != "" {
+		return errors.New("volume assumes a role, its credentials rotate by themselves")
+	}
+	if connInfo.Profile != "" {
+		return errors.New("volume credentials come from the driver shared credentials file")
+	}
+
+	proc, supervised := d.supervisor.process(volumeName)
+	if mountCount > 0 && !supervised {
+		// the mounter would keep the previous credentials until a remount
+		return errors.New("volume is mounted by an unsupervised mounter, its credentials cannot be rotated")
+	}
+	if supervised {
+		if err := proc.rotateCredentials(creds, d.mountTimeout); err != nil {
+			return err
+		}
+		result.Mounted = true
+		logger.Info("mounter-credentials-rotated", lager.Data{"volume": volumeName, "pid": proc.pid})
+	}
+
+	d.volumesLock.Lock()
+	volume.ConnectionInfo.AccessKeyId = request.AccessKeyId
+	volume.ConnectionInfo.SecretAccessKey = request.SecretAccessKey
+	volume.ConnectionInfo.SessionToken = request.SessionToken
+	volume.ConnectionInfo.SessionTokenExpiration = request.SessionTokenExpiration
+	d.volumesLock.Unlock()
+
+	// the mounter already uses the new credentials, but a restart would
+	// bring back the previous ones
+	if err := d.persistVolume(env, volume); err != nil {
+		logger.Error("persist-volume-failed", err, lager.Data{"volume": volumeName})
+		return fmt.Errorf("credentials rotated but not persisted, they are lost on driver restart: %s", err.Error())
+	}
+	return nil
+}
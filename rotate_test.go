@@ -0,0 +1,40 @@
+package s3driver
+
+import (
+	"github.com/orange-cloudfoundry/s3-volume-driver/driveradmin"
+	"os"
+	"testing"
+)
+
+// TestRotateUnsupervisedMountedVolume keeps the credentials of a volume
+// whose mounter cannot be given the new ones.
+func TestRotateUnsupervisedMountedVolume(t *testing.T) {
+	d, env, dir := newTestDriver(t)
+	defer os.RemoveAll(dir)
+
+	if response := createVolume(d, env, "volume"); response.Err != "" {
+		t.Fatal(response.Err)
+	}
+	// mounted by a mounter the driver could not adopt after a restart
+	d.volumesLock.Lock()
+	d.volumes["volume"].MountCount = 1
+	d.volumesLock.Unlock()
+
+	results, err := d.RotateCredentials(env, driveradmin.RotateCredentialsRequest{
+		Volumes:         []string{"volume"},
+		AccessKeyId:     "new-access-key",
+		SecretAccessKey: "new-secret-key",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Err == "" || results[0].Mounted {
+		t.Fatalf("expected the rotation to fail, got %+v", results)
+	}
+
+	d.volumesLock.RLock()
+	defer d.volumesLock.RUnlock()
+	if d.volumes["volume"].ConnectionInfo.AccessKeyId != "access-key" {
+		t.Error("credentials were rotated")
+	}
+}
@@ -14,13 +14,17 @@ import (
 	"fmt"
 	"github.com/cloudfoundry/volumedriver/mountchecker"
 	"github.com/mitchellh/mapstructure"
+	"github.com/orange-cloudfoundry/s3-volume-driver/driveradmin"
+	"github.com/orange-cloudfoundry/s3-volume-driver/params"
 	"sync"
 	"time"
 )
 
 type S3VolumeInfo struct {
-	ConnectionInfo ConnectionInfo
-	mountError     string
+	ConnectionInfo    ConnectionInfo
+	SealedCredentials string
+	RestoreError      string
+	mountFailure      *mountFailure
 	dockerdriver.VolumeInfo
 }
 
@@ -36,9 +40,105 @@ type ConnectionInfo struct {
 	UseSSE          bool              `mapstructure:"use_sse"`
 	UseKMS          bool              `mapstructure:"use_kms"`
 	KMSKeyID        string            `mapstructure:"kms_key_id" json:"-"`
+	SSECKey         string            `mapstructure:"sse_c_key" json:"-"`
 	ACL             string            `mapstructure:"acl"`
 	Subdomain       bool              `mapstructure:"subdomain"`
 	MountOptions    map[string]string `mapstructure:"mount_options"`
+	Prefix          string            `mapstructure:"prefix"`
+	CreatePrefix    bool              `mapstructure:"create_prefix"`
+	ReadOnly        bool              `mapstructure:"readonly"`
+	Uid             *int              `mapstructure:"uid"`
+	Gid             *int              `mapstructure:"gid"`
+	Username        string            `mapstructure:"username"`
+	DirMode         string            `mapstructure:"dir_mode"`
+	FileMode        string            `mapstructure:"file_mode"`
+	StatCacheTTL    string            `mapstructure:"stat_cache_ttl"`
+	TypeCacheTTL    string            `mapstructure:"type_cache_ttl"`
+	HTTPTimeout     string            `mapstructure:"http_timeout"`
+	Cheap           *bool             `mapstructure:"cheap"`
+	ExplicitDir     *bool             `mapstructure:"explicit_dir"`
+	Cache           bool              `mapstructure:"cache"`
+	CacheSize       string            `mapstructure:"cache_size"`
+	SessionToken    string            `mapstructure:"session_token" json:"-"`
+	// SessionTokenExpiration is the RFC 3339 expiry of SessionToken
+	SessionTokenExpiration string `mapstructure:"session_token_expiration"`
+	RoleARN                string `mapstructure:"role_arn"`
+	ExternalID             string `mapstructure:"external_id" json:"-"`
+	RoleSessionName        string `mapstructure:"role_session_name"`
+	// Anonymous volumes mount public buckets without credentials, read-only
+	Anonymous bool `mapstructure:"anonymous"`
+	// Profile names the credentials of the volume in the driver shared
+	// credentials file
+	Profile string `mapstructure:"profile"`
+	// CACert is a PEM bundle trusted for the endpoint on top of the system
+	// and driver CAs
+	CACert             string `mapstructure:"ca_cert"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+	// HTTPProxy and NoProxy override the driver proxy environment for the
+	// volume mounter. HTTPProxy may hold proxy credentials, it is sealed
+	// with the other secrets
+	HTTPProxy string `mapstructure:"http_proxy" json:"-"`
+	NoProxy   string `mapstructure:"no_proxy"`
+	// Validate overrides whether the bucket is checked on create
+	Validate *bool `mapstructure:"validate"`
+}
+
+const defaultMountTimeout = 30 * time.Second
+
+// Config holds the driver wide settings.
+type Config struct {
+	// StateStore is the kind of store volumes persist in, StateStoreJSON
+	// when empty.
+	StateStore string
+	// StateKeyring seals volume credentials in the state file, they are not
+	// persisted when nil.
+	StateKeyring *StateKeyring
+	// MountTimeout bounds the time a mounter has to mount a bucket.
+	MountTimeout time.Duration
+	// MountConcurrency bounds the number of mounters starting at once, the
+	// other mounts wait in a queue. 0 does not bound them.
+	MountConcurrency int
+	// DefaultTuning applies to volumes which do not override it.
+	DefaultTuning Tuning
+	// CacheRoot is where volumes asking for it get a local cache, caching
+	// is disabled when empty.
+	CacheRoot string
+	// CacheVolumeQuota is the default and maximum cache size of a volume.
+	CacheVolumeQuota int64
+	// CacheGlobalQuota bounds the total cache size of the cell, 0 means no
+	// bound.
+	CacheGlobalQuota int64
+	// CatfsPath is the catfs binary providing the local cache.
+	CatfsPath string
+	// CredentialProcess is run by mounters to get fresh credentials once a
+	// volume session token expired. It is given the volume name and prints
+	// credentials in the AWS credential_process format.
+	CredentialProcess string
+	// STSEndpoint overrides the STS endpoint mounters assume volume roles
+	// with.
+	STSEndpoint string
+	// CredentialsFile is the shared credentials file volumes may take their
+	// keys from by naming a profile.
+	CredentialsFile string
+	// TrustedCADir holds PEM files of CAs trusted for every endpoint.
+	TrustedCADir string
+	// AllowInsecureSkipVerify lets volumes disable endpoint certificate
+	// verification.
+	AllowInsecureSkipVerify bool
+	// Policy restricts what volumes may ask for, nil allows anything.
+	Policy *Policy
+	// ValidateOnCreate checks on create the bucket of a volume can be
+	// accessed, volumes may override it with 'validate'.
+	ValidateOnCreate bool
+}
+
+// Tuning are the goofys cache and request settings of a volume.
+type Tuning struct {
+	StatCacheTTL time.Duration
+	TypeCacheTTL time.Duration
+	HTTPTimeout  time.Duration
+	Cheap        bool
+	ExplicitDir  bool
 }
 
 type OsHelper interface {
@@ -48,6 +148,7 @@ type OsHelper interface {
 type S3Driver struct {
 	volumes       map[string]*S3VolumeInfo
 	volumesLock   sync.RWMutex
+	volumeLocks   volumeLocks
 	os            osshim.Os
 	filepath      filepathshim.Filepath
 	ioutil        ioutilshim.Ioutil
@@ -57,6 +158,23 @@ type S3Driver struct {
 	osHelper      OsHelper
 	invoker       invoker.Invoker
 	mounterPath   string
+	stateKeyring  *StateKeyring
+	store         StateStore
+	supervisor    *mounterSupervisor
+	mountTimeout  time.Duration
+	mountQueue    *mountQueue
+	defaultTuning Tuning
+	cache         *volumeCache
+	catfsPath     string
+
+	credentialProcess string
+	stsEndpoint       string
+	credentialsFile   string
+
+	trustedCADir            string
+	allowInsecureSkipVerify bool
+	policy                  *Policy
+	validateOnCreate        bool
 }
 
 func NewS3Driver(
@@ -70,7 +188,12 @@ func NewS3Driver(
 	oshelper OsHelper,
 	invoker invoker.Invoker,
 	mounterPath string,
+	config Config,
 ) *S3Driver {
+	if config.MountTimeout <= 0 {
+		config.MountTimeout = defaultMountTimeout
+	}
+
 	d := &S3Driver{
 		volumes:       map[string]*S3VolumeInfo{},
 		os:            os,
@@ -82,23 +205,55 @@ func NewS3Driver(
 		osHelper:      oshelper,
 		invoker:       invoker,
 		mounterPath:   mounterPath,
+		stateKeyring:  config.StateKeyring,
+		mountTimeout:  config.MountTimeout,
+		mountQueue:    newMountQueue(config.MountConcurrency),
+		defaultTuning: config.DefaultTuning,
+		cache:         newVolumeCache(config.CacheRoot, config.CacheVolumeQuota, config.CacheGlobalQuota),
+		catfsPath:     config.CatfsPath,
+
+		credentialProcess: config.CredentialProcess,
+		stsEndpoint:       config.STSEndpoint,
+		credentialsFile:   config.CredentialsFile,
+
+		trustedCADir:            config.TrustedCADir,
+		allowInsecureSkipVerify: config.AllowInsecureSkipVerify,
+		policy:                  config.Policy,
+		validateOnCreate:        config.ValidateOnCreate,
 	}
 
 	ctx := context.TODO()
 	env := driverhttp.NewHttpDriverEnv(logger, ctx)
 
+	d.supervisor = newMounterSupervisor(
+		logger,
+		func(volumeName string, p params.Mount) (*mounterProcess, error) {
+			return d.spawnMounter(env, volumeName, p)
+		},
+		func(p params.Mount) error {
+			return d.unmountStaleMounts(env, p.MountPoint, p.CacheDir)
+		},
+		d.volumeLocks.lock,
+	)
+
+	store, err := d.openStateStore(logger, config.StateStore)
+	if err != nil {
+		logger.Fatal("failed-to-open-state-store", err)
+	}
+	d.store = store
+
 	d.restoreState(env)
 
 	return d
 }
 
-func (d S3Driver) Activate(env dockerdriver.Env) dockerdriver.ActivateResponse {
+func (d *S3Driver) Activate(env dockerdriver.Env) dockerdriver.ActivateResponse {
 	return dockerdriver.ActivateResponse{
 		Implements: []string{"VolumeDriver"},
 	}
 }
 
-func (d S3Driver) Get(env dockerdriver.Env, getRequest dockerdriver.GetRequest) dockerdriver.GetResponse {
+func (d *S3Driver) Get(env dockerdriver.Env, getRequest dockerdriver.GetRequest) dockerdriver.GetResponse {
 	volume, err := d.getVolume(env, getRequest.Name)
 	if err != nil {
 		return dockerdriver.GetResponse{Err: err.Error()}
@@ -112,20 +267,22 @@ func (d S3Driver) Get(env dockerdriver.Env, getRequest dockerdriver.GetRequest)
 	}
 }
 
-func (d S3Driver) getVolume(env dockerdriver.Env, volumeName string) (*S3VolumeInfo, error) {
+func (d *S3Driver) getVolume(env dockerdriver.Env, volumeName string) (*S3VolumeInfo, error) {
 	logger := env.Logger().Session("get-volume")
 	d.volumesLock.RLock()
 	defer d.volumesLock.RUnlock()
 
 	if vol, ok := d.volumes[volumeName]; ok {
 		logger.Info("getting-volume", lager.Data{"name": volumeName})
-		return vol, nil
+		// a copy, the volume may change once volumesLock is released
+		volume := *vol
+		return &volume, nil
 	}
 
 	return &S3VolumeInfo{}, errors.New("Volume not found")
 }
 
-func (d S3Driver) List(env dockerdriver.Env) dockerdriver.ListResponse {
+func (d *S3Driver) List(env dockerdriver.Env) dockerdriver.ListResponse {
 	d.volumesLock.RLock()
 	defer d.volumesLock.RUnlock()
 
@@ -143,7 +300,42 @@ func (d S3Driver) List(env dockerdriver.Env) dockerdriver.ListResponse {
 	return listResponse
 }
 
-func (d S3Driver) Path(env dockerdriver.Env, pathRequest dockerdriver.PathRequest) dockerdriver.PathResponse {
+// ListVolumes describes every known volume for the admin API.
+func (d *S3Driver) ListVolumes(env dockerdriver.Env) []driveradmin.VolumeInfo {
+	d.volumesLock.RLock()
+	defer d.volumesLock.RUnlock()
+
+	volumes := []driveradmin.VolumeInfo{}
+	for _, volume := range d.volumes {
+		info := driveradmin.VolumeInfo{
+			Name:       volume.Name,
+			Mountpoint: volume.Mountpoint,
+			MountCount: volume.MountCount,
+			Bucket:     volume.ConnectionInfo.Bucket,
+			Prefix:     volume.ConnectionInfo.Prefix,
+			Endpoint:   volume.ConnectionInfo.Endpoint,
+			ReadOnly:   volume.ConnectionInfo.ReadOnly,
+		}
+		if failure := volume.mountFailure; failure != nil && !failure.expired(d.time.Now()) {
+			at := failure.at
+			info.LastMountError = failure.err
+			info.LastMountErrorAt = &at
+			info.MountFailures = failure.failures
+		}
+		if mounter, ok := d.supervisor.info(volume.Name); ok {
+			info.Mounter = &mounter
+		}
+		volumes = append(volumes, info)
+	}
+	return volumes
+}
+
+// MountQueueMetrics describes the mounts waiting to start their mounter.
+func (d *S3Driver) MountQueueMetrics(env dockerdriver.Env) driveradmin.MountQueueMetrics {
+	return d.mountQueue.metrics()
+}
+
+func (d *S3Driver) Path(env dockerdriver.Env, pathRequest dockerdriver.PathRequest) dockerdriver.PathResponse {
 	logger := env.Logger().Session("path", lager.Data{"volume": pathRequest.Name})
 	fmt.Println(pathRequest)
 	if pathRequest.Name == "" {
@@ -181,41 +373,125 @@ func (d *S3Driver) Create(env dockerdriver.Env, createRequest dockerdriver.Creat
 		return dockerdriver.ErrorResponse{Err: err.Error()}
 	}
 
+	bucket, prefix := splitBucket(connInfo.Bucket)
+	if prefix != "" {
+		if connInfo.Prefix != "" {
+			return dockerdriver.ErrorResponse{Err: "'prefix' must not be given both in 'bucket' and 'prefix' fields in 'Opts'"}
+		}
+		connInfo.Prefix = prefix
+	}
+	connInfo.Bucket = bucket
+
 	if connInfo.Bucket == "" {
 		return dockerdriver.ErrorResponse{Err: "Missing mandatory 'bucket' field in 'Opts'"}
 	}
-	if connInfo.AccessKeyId == "" {
+	connInfo.Prefix, err = normalizePrefix(connInfo.Prefix)
+	if err != nil {
+		return dockerdriver.ErrorResponse{Err: err.Error()}
+	}
+	if connInfo.Anonymous {
+		if connInfo.AccessKeyId != "" || connInfo.SecretAccessKey != "" || connInfo.SessionToken != "" || connInfo.RoleARN != "" {
+			return dockerdriver.ErrorResponse{Err: "'anonymous' cannot be combined with 'access_key_id', 'secret_access_key', 'session_token' or 'role_arn'"}
+		}
+		connInfo.ReadOnly = true
+	}
+	if err := d.policy.check(connInfo); err != nil {
+		logger.Error("volume-breaks-policy", err)
+		return dockerdriver.ErrorResponse{Err: errorText(logger, dockerdriver.SafeError{SafeDescription: err.Error()})}
+	}
+	if connInfo.ReadOnly && connInfo.CreatePrefix {
+		return dockerdriver.ErrorResponse{Err: "'create_prefix' cannot be used on a 'readonly' volume"}
+	}
+	if err := resolveOwnership(&connInfo); err != nil {
+		return dockerdriver.ErrorResponse{Err: err.Error()}
+	}
+	if _, err := resolveTuning(connInfo, d.defaultTuning); err != nil {
+		return dockerdriver.ErrorResponse{Err: err.Error()}
+	}
+	if connInfo.Cache {
+		if !d.cache.enabled() {
+			return dockerdriver.ErrorResponse{Err: "'cache' is not available, the driver has no cache directory"}
+		}
+		if _, err := d.cache.size(connInfo.CacheSize); err != nil {
+			return dockerdriver.ErrorResponse{Err: err.Error()}
+		}
+	}
+	if err := resolveRole(&connInfo, createRequest.Name); err != nil {
+		return dockerdriver.ErrorResponse{Err: err.Error()}
+	}
+	if err := d.checkProfile(connInfo); err != nil {
+		return dockerdriver.ErrorResponse{Err: err.Error()}
+	}
+	if connInfo.CACert != "" {
+		if err := checkCACert(connInfo.CACert); err != nil {
+			return dockerdriver.ErrorResponse{Err: err.Error()}
+		}
+	}
+	if connInfo.SSECKey != "" {
+		if err := checkSSECKey(connInfo); err != nil {
+			return dockerdriver.ErrorResponse{Err: err.Error()}
+		}
+	}
+	if connInfo.HTTPProxy != "" {
+		if err := checkProxy(connInfo.HTTPProxy); err != nil {
+			return dockerdriver.ErrorResponse{Err: err.Error()}
+		}
+	}
+	if connInfo.InsecureSkipVerify && !d.allowInsecureSkipVerify {
+		return dockerdriver.ErrorResponse{Err: "'insecure_skip_verify' is not allowed by the driver"}
+	}
+	if !hasOwnCredentials(connInfo) && connInfo.AccessKeyId == "" {
 		return dockerdriver.ErrorResponse{Err: "Missing mandatory 'access_key_id' field in 'Opts'"}
 	}
-	if connInfo.SecretAccessKey == "" {
+	if !hasOwnCredentials(connInfo) && connInfo.SecretAccessKey == "" {
 		return dockerdriver.ErrorResponse{Err: "Missing mandatory 'secret_access_key' field in 'Opts'"}
 	}
+	if connInfo.SessionTokenExpiration != "" {
+		if connInfo.SessionToken == "" {
+			return dockerdriver.ErrorResponse{Err: "'session_token_expiration' requires a 'session_token'"}
+		}
+		if _, err := parseExpiration(connInfo.SessionTokenExpiration); err != nil {
+			return dockerdriver.ErrorResponse{Err: err.Error()}
+		}
+	}
+
+	validate := d.validateOnCreate
+	if connInfo.Validate != nil {
+		validate = *connInfo.Validate
+	}
+	if validate {
+		if err := d.preflight(driverhttp.EnvWithLogger(logger, env), createRequest.Name, connInfo); err != nil {
+			logger.Error("bucket-validation-failed", err)
+			return dockerdriver.ErrorResponse{Err: errorText(logger, err)}
+		}
+	}
+
+	unlock := d.volumeLocks.lock(createRequest.Name)
+	defer unlock()
 
 	existing, err := d.getVolume(driverhttp.EnvWithLogger(logger, env), createRequest.Name)
 
+	var volume *S3VolumeInfo
 	if err != nil {
 		logger.Info("creating-volume", lager.Data{"volume_name": createRequest.Name})
 		logger.Info("with-opts", lager.Data{"opts": createRequest.Opts})
 
-		volInfo := S3VolumeInfo{
+		volume = &S3VolumeInfo{
 			VolumeInfo:     dockerdriver.VolumeInfo{Name: createRequest.Name},
 			ConnectionInfo: connInfo,
 		}
-
-		d.volumesLock.Lock()
-		defer d.volumesLock.Unlock()
-
-		d.volumes[createRequest.Name] = &volInfo
 	} else {
 		existing.ConnectionInfo = connInfo
-
-		d.volumesLock.Lock()
-		defer d.volumesLock.Unlock()
-
-		d.volumes[createRequest.Name] = existing
+		// new credentials replace the ones which could not be unsealed
+		existing.SealedCredentials = ""
+		volume = existing
 	}
 
-	err = d.persistState(driverhttp.EnvWithLogger(logger, env))
+	d.volumesLock.Lock()
+	d.volumes[createRequest.Name] = volume
+	d.volumesLock.Unlock()
+
+	err = d.persistVolume(driverhttp.EnvWithLogger(logger, env), volume)
 	if err != nil {
 		logger.Error("persist-state-failed", err)
 		return dockerdriver.ErrorResponse{Err: fmt.Sprintf("persist state failed when creating: %s", err.Error())}
@@ -233,6 +509,9 @@ func (d *S3Driver) Remove(env dockerdriver.Env, removeRequest dockerdriver.Remov
 		return dockerdriver.ErrorResponse{Err: "Missing mandatory 'volume_name'"}
 	}
 
+	unlock := d.volumeLocks.lock(removeRequest.Name)
+	defer unlock()
+
 	vol, err := d.getVolume(driverhttp.EnvWithLogger(logger, env), removeRequest.Name)
 
 	if err != nil {
@@ -249,17 +528,17 @@ func (d *S3Driver) Remove(env dockerdriver.Env, removeRequest dockerdriver.Remov
 	logger.Info("removing-volume", lager.Data{"name": removeRequest.Name})
 
 	d.volumesLock.Lock()
-	defer d.volumesLock.Unlock()
 	delete(d.volumes, removeRequest.Name)
+	d.volumesLock.Unlock()
 
-	if err := d.persistState(driverhttp.EnvWithLogger(logger, env)); err != nil {
+	if err := d.removeVolumeState(driverhttp.EnvWithLogger(logger, env), removeRequest.Name); err != nil {
 		return dockerdriver.ErrorResponse{Err: fmt.Sprintf("failed to persist state when removing: %s", err.Error())}
 	}
 
 	return dockerdriver.ErrorResponse{}
 }
 
-func (d S3Driver) Capabilities(env dockerdriver.Env) dockerdriver.CapabilitiesResponse {
+func (d *S3Driver) Capabilities(env dockerdriver.Env) dockerdriver.CapabilitiesResponse {
 	return dockerdriver.CapabilitiesResponse{
 		Capabilities: dockerdriver.CapabilityInfo{Scope: "local"},
 	}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"github.com/kahing/goofys/api"
+	"github.com/orange-cloudfoundry/s3-volume-driver/params"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+const (
+	cacheMountTimeout  = 10 * time.Second
+	cacheEvictInterval = 30 * time.Second
+)
+
+// localCache is a catfs filesystem stacked on top of goofys: goofys is
+// mounted in the backing directory and catfs serves it on the volume
+// mountpoint, keeping the files it reads in the cache data directory.
+type localCache struct {
+	backing string
+	data    string
+	catfs   *exec.Cmd
+
+	// closed once catfs exited, err is then its exit error
+	done chan struct{}
+	err  error
+}
+
+func cacheBacking(p params.Mount) string {
+	return filepath.Join(p.CacheDir, "backing")
+}
+
+func startLocalCache(p params.Mount) (*localCache, error) {
+	c := &localCache{
+		backing: cacheBacking(p),
+		data:    filepath.Join(p.CacheDir, "data"),
+		done:    make(chan struct{}),
+	}
+	if err := os.MkdirAll(c.data, 0700); err != nil {
+		return nil, err
+	}
+
+	args := []string{"-f", "-o", "allow_other"}
+	if p.ReadOnly {
+		args = append(args, "-o", "ro")
+	}
+	args = append(args, "--", c.backing, c.data, p.MountPoint)
+
+	c.catfs = exec.Command(p.CatfsPath, args...)
+	c.catfs.Env = append(os.Environ(), "RUST_LOG=info")
+	c.catfs.Stdout = os.Stdout
+	c.catfs.Stderr = os.Stdout
+	if err := c.catfs.Start(); err != nil {
+		return nil, err
+	}
+	go func() {
+		c.err = c.catfs.Wait()
+		close(c.done)
+	}()
+
+	if err := c.waitForMount(p.MountPoint); err != nil {
+		c.catfs.Process.Kill()
+		return nil, err
+	}
+
+	go c.evict(p.CacheSize)
+	return c, nil
+}
+
+// wait blocks until catfs exits, then releases the goofys backing mount.
+func (c *localCache) wait() error {
+	<-c.done
+	if c.err != nil {
+		log.Errorf("catfs exited: %v", c.err)
+	}
+	if err := goofys.TryUnmount(c.backing); err != nil {
+		log.Errorf("Unable to unmount cache backing %s: %v", c.backing, err)
+	}
+	return c.err
+}
+
+// waitForMount returns once a filesystem is mounted on mountPoint, detected
+// by the mountpoint moving to another device than its parent.
+func (c *localCache) waitForMount(mountPoint string) error {
+	var parent syscall.Stat_t
+	if err := syscall.Stat(filepath.Dir(mountPoint), &parent); err != nil {
+		return err
+	}
+
+	deadline := time.After(cacheMountTimeout)
+	for {
+		var st syscall.Stat_t
+		if err := syscall.Stat(mountPoint, &st); err == nil && st.Dev != parent.Dev {
+			return nil
+		}
+
+		select {
+		case <-c.done:
+			return fmt.Errorf("catfs exited before mounting: %v", c.err)
+		case <-deadline:
+			return fmt.Errorf("catfs did not mount within %s", cacheMountTimeout)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+type cachedFile struct {
+	path  string
+	size  int64
+	atime time.Time
+}
+
+// evict keeps the cache data directory under quota by removing the least
+// recently read files.
+func (c *localCache) evict(quota int64) {
+	if quota <= 0 {
+		return
+	}
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-time.After(cacheEvictInterval):
+		}
+
+		var files []cachedFile
+		var total int64
+		filepath.Walk(c.data, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return nil
+			}
+			st := info.Sys().(*syscall.Stat_t)
+			// cached files are sparse, only count what is on disk
+			f := cachedFile{
+				path:  path,
+				size:  st.Blocks * 512,
+				atime: time.Unix(st.Atim.Sec, st.Atim.Nsec),
+			}
+			files = append(files, f)
+			total += f.size
+			return nil
+		})
+		if total <= quota {
+			continue
+		}
+
+		sort.Slice(files, func(i, j int) bool { return files[i].atime.Before(files[j].atime) })
+		target := quota / 10 * 9
+		for _, f := range files {
+			if total <= target {
+				break
+			}
+			if err := os.Remove(f.path); err != nil {
+				log.Errorf("Unable to evict %s from cache: %v", f.path, err)
+				continue
+			}
+			total -= f.size
+		}
+		log.Infof("Cache evicted down to %d bytes (quota %d)", total, quota)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/orange-cloudfoundry/s3-volume-driver/params"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+)
+
+// serveControl answers the requests of the driver until it closes the
+// control socket. The volume stays mounted whatever happens here.
+func serveControl(control *os.File, volume *mountedVolume) {
+	defer control.Close()
+
+	decoder := json.NewDecoder(control)
+	encoder := json.NewEncoder(control)
+	for {
+		var request params.ControlRequest
+		if err := decoder.Decode(&request); err != nil {
+			if err != io.EOF {
+				log.Errorf("Unable to read control request: %v", err)
+			}
+			return
+		}
+
+		var response params.ControlResponse
+		switch {
+		case request.RotateCredentials != nil:
+			if err := volume.rotateCredentials(*request.RotateCredentials); err != nil {
+				log.Errorf("Unable to rotate credentials: %v", err)
+				response.Error = err.Error()
+			} else {
+				log.Info("Credentials rotated")
+			}
+		default:
+			response.Error = "unknown control request"
+		}
+
+		if err := encoder.Encode(response); err != nil {
+			log.Errorf("Unable to answer control request: %v", err)
+			return
+		}
+	}
+}
+
+// rotateCredentials swaps the keys used by goofys once they are known to
+// work. goofys keeps running so open files are not affected.
+func (v *mountedVolume) rotateCredentials(creds params.Credentials) error {
+	if v.credentials == nil {
+		return errors.New("volume credentials cannot be rotated")
+	}
+	if creds.AccessKeyId == "" || creds.SecretAccessKey == "" {
+		return errors.New("access key id and secret access key are mandatory")
+	}
+
+	value := credentials.Value{
+		AccessKeyID:     creds.AccessKeyId,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+	}
+	err := checkCredentials(v.params, v.awsConfig, credentials.NewStaticCredentialsFromCreds(value))
+	if err != nil {
+		log.Errorf("New credentials rejected: %v", err)
+		if isAccessDenied(err) {
+			return errors.New("new credentials are denied access to the bucket")
+		}
+		return errors.New("unable to check new credentials against the bucket")
+	}
+
+	v.credentials.rotate(value, creds.SessionTokenExpiration)
+	v.awsConfig.Credentials.Expire()
+	return nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/orange-cloudfoundry/s3-volume-driver/params"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// credentials are refreshed this long before they expire
+	credentialsExpiryWindow  = 1 * time.Minute
+	credentialProcessTimeout = 1 * time.Minute
+)
+
+// newCredentials returns the credentials of a volume: none for anonymous
+// volumes, the role it assumes, its profile in the shared credentials file
+// or the keys it was created with. awsConfig is the volume configuration,
+// still without credentials and endpoint. Keys may later be rotated through
+// the returned provider, which is nil otherwise.
+func newCredentials(p params.Mount, awsConfig *aws.Config) (*credentials.Credentials, *sessionProvider, error) {
+	if p.Anonymous {
+		return credentials.AnonymousCredentials, nil, nil
+	}
+	if p.RoleARN != "" {
+		creds, err := newRoleCredentials(p, awsConfig)
+		return creds, nil, err
+	}
+	if p.Profile != "" {
+		return credentials.NewCredentials(&sharedFileProvider{
+			SharedCredentialsProvider: credentials.SharedCredentialsProvider{
+				Filename: p.CredentialsFile,
+				Profile:  p.Profile,
+			},
+		}), nil, nil
+	}
+
+	provider := &sessionProvider{
+		initial: credentials.Value{
+			AccessKeyID:     p.AccessKeyId,
+			SecretAccessKey: p.SecretAccessKey,
+			SessionToken:    p.SessionToken,
+			ProviderName:    "VolumeCredentials",
+		},
+		expiration: p.SessionTokenExpiration,
+	}
+	if p.CredentialProcess != "" {
+		provider.refresh = &processProvider{
+			command:    p.CredentialProcess,
+			volumeName: p.VolumeName,
+		}
+	}
+	return credentials.NewCredentials(provider), provider, nil
+}
+
+// newRoleCredentials assumes the volume role with the base credentials of
+// the driver, found in its environment, shared credentials file or instance
+// profile. They are refreshed before they expire.
+func newRoleCredentials(p params.Mount, awsConfig *aws.Config) (*credentials.Credentials, error) {
+	stsConfig := &aws.Config{
+		Region:     awsConfig.Region,
+		HTTPClient: awsConfig.HTTPClient,
+		Logger:     awsConfig.Logger,
+	}
+	if p.STSEndpoint != "" {
+		stsConfig.Endpoint = aws.String(p.STSEndpoint)
+	}
+	sess, err := session.NewSession(stsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return stscreds.NewCredentials(sess, p.RoleARN, func(provider *stscreds.AssumeRoleProvider) {
+		provider.RoleSessionName = p.RoleSessionName
+		if p.ExternalID != "" {
+			provider.ExternalID = aws.String(p.ExternalID)
+		}
+		provider.ExpiryWindow = credentialsExpiryWindow
+	}), nil
+}
+
+// sessionProvider serves the credentials the volume was created with until
+// they expire or get rejected, then the ones of the refresh source. Without
+// refresh source the volume credentials are served forever.
+type sessionProvider struct {
+	initial    credentials.Value
+	expiration time.Time
+	refresh    credentials.Provider
+
+	lock       sync.Mutex
+	retrieved  bool
+	refreshing bool
+}
+
+// rotate replaces the volume credentials. They are served from the next
+// retrieve on, once the caller expired the current ones.
+func (s *sessionProvider) rotate(value credentials.Value, expiration time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	value.ProviderName = s.initial.ProviderName
+	s.initial = value
+	s.expiration = expiration
+	s.retrieved = false
+	s.refreshing = false
+}
+
+func (s *sessionProvider) Retrieve() (credentials.Value, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.refresh == nil {
+		return s.initial, nil
+	}
+
+	// a second retrieve means the SDK expired the credentials, either
+	// because IsExpired said so or because S3 rejected the token
+	if !s.retrieved && !s.initialExpired() {
+		s.retrieved = true
+		return s.initial, nil
+	}
+	s.retrieved = true
+
+	value, err := s.refresh.Retrieve()
+	if err != nil {
+		log.Errorf("Unable to refresh credentials: %v", err)
+		return credentials.Value{}, err
+	}
+	if !s.refreshing {
+		log.Infof("Volume credentials expired, now using %s", value.ProviderName)
+		s.refreshing = true
+	}
+	return value, nil
+}
+
+func (s *sessionProvider) IsExpired() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.refreshing {
+		return s.refresh.IsExpired()
+	}
+	return s.refresh != nil && s.initialExpired()
+}
+
+func (s *sessionProvider) initialExpired() bool {
+	return !s.expiration.IsZero() && !time.Now().Add(credentialsExpiryWindow).Before(s.expiration)
+}
+
+// processProvider gets credentials from a command given the volume name,
+// which prints them in the AWS credential_process format.
+type processProvider struct {
+	command    string
+	volumeName string
+	expiration time.Time
+}
+
+type processCredentials struct {
+	Version         int
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      *time.Time
+}
+
+func (p *processProvider) Retrieve() (credentials.Value, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), credentialProcessTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, p.command, p.volumeName)
+	cmd.Stderr = os.Stdout
+	output, err := cmd.Output()
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("credential process %s failed: %v", p.command, err)
+	}
+
+	var creds processCredentials
+	if err := json.Unmarshal(output, &creds); err != nil {
+		return credentials.Value{}, fmt.Errorf("credential process %s printed invalid JSON: %v", p.command, err)
+	}
+	if creds.Version != 1 {
+		return credentials.Value{}, fmt.Errorf("credential process %s printed unsupported version %d", p.command, creds.Version)
+	}
+	if strings.TrimSpace(creds.AccessKeyId) == "" || strings.TrimSpace(creds.SecretAccessKey) == "" {
+		return credentials.Value{}, errors.New("credential process " + p.command + " printed no access key id or secret access key")
+	}
+
+	p.expiration = time.Time{}
+	if creds.Expiration != nil {
+		p.expiration = *creds.Expiration
+	}
+	return credentials.Value{
+		AccessKeyID:     creds.AccessKeyId,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+		ProviderName:    "CredentialProcess",
+	}, nil
+}
+
+func (p *processProvider) IsExpired() bool {
+	return !p.expiration.IsZero() && !time.Now().Add(credentialsExpiryWindow).Before(p.expiration)
+}
+
+// sharedFileProvider reads a profile of a shared credentials file again
+// whenever the file changes, so operators can rotate keys in place.
+type sharedFileProvider struct {
+	credentials.SharedCredentialsProvider
+	modTime time.Time
+}
+
+func (s *sharedFileProvider) Retrieve() (credentials.Value, error) {
+	if info, err := os.Stat(s.Filename); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return s.SharedCredentialsProvider.Retrieve()
+}
+
+func (s *sharedFileProvider) IsExpired() bool {
+	info, err := os.Stat(s.Filename)
+	if err != nil {
+		return false
+	}
+	return !info.ModTime().Equal(s.modTime) || s.SharedCredentialsProvider.IsExpired()
+}
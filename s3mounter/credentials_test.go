@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/orange-cloudfoundry/s3-volume-driver/params"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+const assumeRoleResponse = `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>ASIA%d</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>token</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+    <AssumedRoleUser>
+      <Arn>arn:aws:sts::123456789012:assumed-role/volume/session</Arn>
+      <AssumedRoleId>AROA:session</AssumedRoleId>
+    </AssumedRoleUser>
+  </AssumeRoleResult>
+  <ResponseMetadata>
+    <RequestId>request</RequestId>
+  </ResponseMetadata>
+</AssumeRoleResponse>`
+
+// fakeSTS answers AssumeRole with credentials expiring after lifetime, and
+// records the form of each request.
+type fakeSTS struct {
+	lifetime time.Duration
+
+	lock        sync.Mutex
+	requests    []map[string]string
+	expirations []time.Time
+}
+
+func (s *fakeSTS) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	form := map[string]string{}
+	for key := range req.PostForm {
+		form[key] = req.PostForm.Get(key)
+	}
+	s.requests = append(s.requests, form)
+	// STS expirations have a second precision
+	expiration := time.Now().Add(s.lifetime).UTC().Truncate(time.Second).Add(time.Second)
+	s.expirations = append(s.expirations, expiration)
+
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprintf(w, assumeRoleResponse, len(s.requests), expiration.Format(time.RFC3339))
+}
+
+func (s *fakeSTS) calls() ([]map[string]string, []time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]map[string]string{}, s.requests...), append([]time.Time{}, s.expirations...)
+}
+
+func TestRoleCredentialsRefreshBeforeExpiry(t *testing.T) {
+	// the base credentials of the driver
+	for key, value := range map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKID",
+		"AWS_SECRET_ACCESS_KEY": "SECRET",
+		"AWS_SESSION_TOKEN":     "",
+	} {
+		previous, set := os.LookupEnv(key)
+		os.Setenv(key, value)
+		if set {
+			defer os.Setenv(key, previous)
+		} else {
+			defer os.Unsetenv(key)
+		}
+	}
+
+	sts := &fakeSTS{lifetime: credentialsExpiryWindow + time.Second}
+	server := httptest.NewServer(sts)
+	defer server.Close()
+
+	creds, err := newRoleCredentials(params.Mount{
+		RoleARN:         "arn:aws:iam::123456789012:role/volume",
+		ExternalID:      "external-id",
+		RoleSessionName: "volume-session",
+		STSEndpoint:     server.URL,
+	}, &aws.Config{Region: aws.String("us-east-1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := creds.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.AccessKeyID != "ASIA1" || value.SessionToken != "token" {
+		t.Errorf("unexpected credentials %+v", value)
+	}
+
+	requests, _ := sts.calls()
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 AssumeRole call, got %d", len(requests))
+	}
+	for key, expected := range map[string]string{
+		"Action":          "AssumeRole",
+		"RoleArn":         "arn:aws:iam::123456789012:role/volume",
+		"ExternalId":      "external-id",
+		"RoleSessionName": "volume-session",
+	} {
+		if requests[0][key] != expected {
+			t.Errorf("AssumeRole %s is %q, expected %q", key, requests[0][key], expected)
+		}
+	}
+
+	// valid credentials are not assumed again
+	if _, err := creds.Get(); err != nil {
+		t.Fatal(err)
+	}
+	if requests, _ := sts.calls(); len(requests) != 1 {
+		t.Fatalf("expected 1 AssumeRole call, got %d", len(requests))
+	}
+
+	// they expire once within the expiry window
+	deadline := time.Now().Add(5 * time.Second)
+	for !creds.IsExpired() {
+		if time.Now().After(deadline) {
+			t.Fatal("credentials were not expired within the expiry window")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	value, err = creds.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests, expirations := sts.calls()
+	if len(requests) != 2 || value.AccessKeyID != "ASIA2" {
+		t.Fatalf("expected the credentials to be refreshed, got %d calls and %s", len(requests), value.AccessKeyID)
+	}
+	if !time.Now().Before(expirations[0]) {
+		t.Error("credentials were refreshed after they expired")
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/kahing/goofys/api"
+	"github.com/sirupsen/logrus"
+)
+
+// mountGoofys does what goofys.Mount does without a cache, but with our own
+// AWS configuration: goofys.Mount only knows static credentials and drops
+// the session token.
+func mountGoofys(ctx context.Context, bucket string, flags *goofys.FlagStorage, awsConfig *aws.Config) (*goofys.Goofys, *fuse.MountedFileSystem, error) {
+	fs := goofys.NewGoofys(ctx, bucket, awsConfig, flags)
+	if fs == nil {
+		return nil, nil, fmt.Errorf("Mount: initialization failed")
+	}
+
+	mfs, err := fuse.Mount(flags.MountPoint, fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{
+		FSName:                  bucket,
+		Options:                 flags.MountOptions,
+		ErrorLogger:             goofys.GetStdLogger(goofys.NewLogger("fuse"), logrus.ErrorLevel),
+		DisableWritebackCaching: true,
+	})
+	if err != nil {
+		return fs, nil, fmt.Errorf("Mount: %v", err)
+	}
+	return fs, mfs, nil
+}
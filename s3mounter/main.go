@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"github.com/kahing/goofys/api"
 	"github.com/orange-cloudfoundry/s3-volume-driver/params"
@@ -18,16 +17,25 @@ func init() {
 }
 
 func main() {
+	// processes started by the mounter must not inherit the control socket
+	syscall.CloseOnExec(params.ControlFd)
+	control := os.NewFile(params.ControlFd, "control")
+
 	if len(os.Args) < 2 {
-		log.Fatalf("Volume name is mandatory")
-		syscall.Kill(os.Getppid(), syscall.SIGUSR2)
+		exitWithFailure(control, mountFailure{
+			errType: params.ErrInvalidParams,
+			message: "volume name is mandatory",
+		})
 	}
 	syscall.Umask(000)
 	var mountParams params.Mount
 	err := json.NewDecoder(os.Stdin).Decode(&mountParams)
 	if err != nil {
-		log.Fatal(err)
-		syscall.Kill(os.Getppid(), syscall.SIGUSR2)
+		exitWithFailure(control, mountFailure{
+			errType: params.ErrInvalidParams,
+			message: "invalid mount parameters",
+			err:     err,
+		})
 	}
 
 	formatter := NewLogFormatter(os.Args[1])
@@ -35,18 +43,51 @@ func main() {
 	goofys.GetLogger("main").SetFormatter(formatter)
 	goofys.GetLogger("fuse").SetFormatter(formatter)
 
-	mfs, err := mount(mountParams)
+	if mountParams.Preflight {
+		if err := preflight(mountParams); err != nil {
+			exitWithFailure(control, err)
+		}
+		if err := json.NewEncoder(control).Encode(params.MountResult{}); err != nil {
+			log.Errorf("Unable to report preflight result: %v", err)
+		}
+		return
+	}
+
+	volume, err := mount(mountParams)
 	if err != nil {
-		log.Fatal(err)
-		syscall.Kill(os.Getppid(), syscall.SIGUSR2)
+		exitWithFailure(control, err)
 	}
 
-	syscall.Kill(os.Getppid(), syscall.SIGUSR1)
+	if err := json.NewEncoder(control).Encode(params.MountResult{}); err != nil {
+		log.Errorf("Unable to report mount result: %v", err)
+	}
+	go serveControl(control, volume)
 
 	time.Sleep(1 * time.Second)
 	log.Info("test")
-	if err = mfs.Join(context.Background()); err != nil {
+	if err = volume.join(); err != nil {
 		log.Fatalf("Join: %v", err)
 	}
 
 }
+
+// exitWithFailure reports err to the driver and exits.
+func exitWithFailure(control *os.File, err error) {
+	failure, ok := err.(mountFailure)
+	if !ok {
+		failure = mountFailure{
+			errType: params.ErrMountFailed,
+			message: "unable to mount volume",
+			err:     err,
+		}
+	}
+	log.Error(failure)
+
+	result := params.MountResult{
+		Error: &params.MountError{Type: failure.errType, Message: failure.message},
+	}
+	if err := json.NewEncoder(control).Encode(result); err != nil {
+		log.Errorf("Unable to report mount result: %v", err)
+	}
+	os.Exit(1)
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/hashicorp/go-multierror"
 	"github.com/jacobsa/fuse"
 	"github.com/kahing/goofys/api"
@@ -9,10 +12,119 @@ import (
 	"os"
 )
 
-func mount(p params.Mount) (*fuse.MountedFileSystem, error) {
+// mountFailure is a mount error carrying a message safe to show to users
+// alongside the detailed cause.
+type mountFailure struct {
+	errType string
+	message string
+	err     error
+}
+
+func (f mountFailure) Error() string {
+	if f.err == nil {
+		return f.message
+	}
+	return fmt.Sprintf("%s: %s", f.message, f.err.Error())
+}
+
+// mountedVolume is a goofys filesystem, optionally served through a local
+// cache.
+type mountedVolume struct {
+	params     params.Mount
+	mountPoint string
+	mfs        *fuse.MountedFileSystem
+	cache      *localCache
+
+	awsConfig   *aws.Config
+	credentials *sessionProvider
+}
+
+// join blocks until the volume is unmounted.
+func (v *mountedVolume) join() error {
+	if v.cache != nil {
+		// goofys stays mounted on the cache backing until catfs exits
+		go v.cache.wait()
+	}
+
+	if err := v.mfs.Join(context.Background()); err != nil {
+		return err
+	}
+
+	if v.cache != nil {
+		select {
+		case <-v.cache.done:
+			return v.cache.err
+		default:
+			// goofys went away from under catfs
+			goofys.TryUnmount(v.mountPoint)
+			return errors.New("cache backing unmounted while catfs was running")
+		}
+	}
+	return nil
+}
+
+func mount(p params.Mount) (*mountedVolume, error) {
+	if p.Anonymous {
+		// nobody may write to a bucket without credentials
+		p.ReadOnly = true
+	}
+
 	err := os.MkdirAll(p.MountPoint, os.ModePerm)
 	if err != nil {
-		return nil, err
+		return nil, mountFailure{
+			errType: params.ErrMountPoint,
+			message: "unable to create mountpoint",
+			err:     err,
+		}
+	}
+
+	goofysMountPoint := p.MountPoint
+	if p.CacheDir != "" {
+		goofysMountPoint = cacheBacking(p)
+		if err := os.MkdirAll(goofysMountPoint, 0700); err != nil {
+			return nil, mountFailure{
+				errType: params.ErrMountPoint,
+				message: "unable to create cache directory",
+				err:     err,
+			}
+		}
+	}
+
+	awsConfig, provider, err := newAWSConfig(p)
+	if err != nil {
+		return nil, mountFailure{
+			errType: params.ErrInvalidParams,
+			message: "unable to set up bucket connection, check credentials and CA certificates",
+			err:     err,
+		}
+	}
+
+	bucket := p.Bucket
+	if p.Prefix != "" {
+		bucket = p.Bucket + ":" + p.Prefix
+
+		if p.CreatePrefix {
+			if err := ensurePrefix(p, awsConfig); err != nil {
+				message := fmt.Sprintf("unable to create prefix '%s' in bucket '%s'", p.Prefix, p.Bucket)
+				if isAccessDenied(err) {
+					message += ": access denied"
+				}
+				return nil, mountFailure{
+					errType: params.ErrBucketAccess,
+					message: message,
+					err:     err,
+				}
+			}
+		}
+	}
+
+	dirMode := p.DirMode
+	if dirMode == 0 {
+		dirMode = 0777
+	}
+	fileMode := p.FileMode
+	if fileMode == 0 {
+		fileMode = 0666
 	}
 
 	mountOptions := p.MountOptions
@@ -20,19 +132,21 @@ func mount(p params.Mount) (*fuse.MountedFileSystem, error) {
 		mountOptions = make(map[string]string)
 	}
 	mountOptions["allow_other"] = ""
-	_, mfs, err := goofys.Mount(context.Background(), p.Bucket, &goofys.Config{
-		MountPoint: p.MountPoint,
+	if p.ReadOnly {
+		delete(mountOptions, "rw")
+		mountOptions["ro"] = ""
+	}
+	fs, mfs, err := mountGoofys(context.Background(), bucket, &goofys.FlagStorage{
+		MountPoint: goofysMountPoint,
 
-		DirMode:      0777,
-		FileMode:     0666,
+		DirMode:      dirMode,
+		FileMode:     fileMode,
 		MountOptions: mountOptions,
 		Uid:          uint32(p.Uid),
 		Gid:          uint32(p.Gid),
 
 		Endpoint:       p.Endpoint,
-		AccessKey:      p.AccessKeyId,
-		SecretKey:      p.SecretAccessKey,
-		Region:         p.Region,
+		Region:         aws.StringValue(awsConfig.Region),
 		RegionSet:      p.RegionSet,
 		StorageClass:   p.StorageClass,
 		UseContentType: p.UseContentType,
@@ -41,14 +155,53 @@ func mount(p params.Mount) (*fuse.MountedFileSystem, error) {
 		ACL:            p.ACL,
 		Subdomain:      p.Subdomain,
 		KMSKeyID:       p.KMSKeyID,
-	})
+
+		Cheap:        p.Cheap,
+		ExplicitDir:  p.ExplicitDir,
+		StatCacheTTL: p.StatCacheTTL,
+		TypeCacheTTL: p.TypeCacheTTL,
+		HTTPTimeout:  p.HTTPTimeout,
+	}, awsConfig)
 	if err != nil {
 		result := err
-		rm_err := os.Remove(p.MountPoint)
+		rm_err := os.Remove(goofysMountPoint)
 		if rm_err != nil {
 			result = multierror.Append(result, rm_err)
 		}
-		return nil, result
+		if fs == nil {
+			// goofys could not reach the bucket with the given parameters
+			return nil, mountFailure{
+				errType: params.ErrBucketAccess,
+				message: fmt.Sprintf("unable to access bucket '%s', check bucket name, endpoint, region and credentials", p.Bucket),
+				err:     result,
+			}
+		}
+		return nil, mountFailure{
+			errType: params.ErrMountFailed,
+			message: "unable to mount fuse filesystem",
+			err:     result,
+		}
+	}
+
+	volume := &mountedVolume{
+		params:      p,
+		mountPoint:  p.MountPoint,
+		mfs:         mfs,
+		awsConfig:   awsConfig,
+		credentials: provider,
+	}
+	if p.CacheDir != "" {
+		volume.cache, err = startLocalCache(p)
+		if err != nil {
+			if unmountErr := goofys.TryUnmount(goofysMountPoint); unmountErr != nil {
+				err = multierror.Append(err, unmountErr)
+			}
+			return nil, mountFailure{
+				errType: params.ErrMountFailed,
+				message: "unable to start local cache",
+				err:     err,
+			}
+		}
 	}
-	return mfs, nil
+	return volume, nil
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/orange-cloudfoundry/s3-volume-driver/params"
+	"net/http"
+	"strings"
+)
+
+// preflight checks the bucket and prefix of a volume can be reached with its
+// credentials, without mounting anything.
+func preflight(p params.Mount) error {
+	awsConfig, _, err := newAWSConfig(p)
+	if err != nil {
+		return mountFailure{
+			errType: params.ErrInvalidParams,
+			message: "unable to set up bucket connection, check credentials and CA certificates",
+			err:     err,
+		}
+	}
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return mountFailure{
+			errType: params.ErrInvalidParams,
+			message: "unable to set up bucket connection",
+			err:     err,
+		}
+	}
+	client := s3.New(sess)
+
+	req, _ := client.HeadBucketRequest(&s3.HeadBucketInput{Bucket: aws.String(p.Bucket)})
+	err = req.Send()
+	bucketRegion := ""
+	if req.HTTPResponse != nil {
+		bucketRegion = req.HTTPResponse.Header.Get("X-Amz-Bucket-Region")
+	}
+	if err != nil && !p.RegionSet && isRedirect(err) && bucketRegion != "" {
+		// goofys detects the bucket region the same way when mounting
+		client = s3.New(sess, &aws.Config{Region: aws.String(bucketRegion)})
+		_, err = client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(p.Bucket)})
+	}
+	if err != nil {
+		return preflightFailure(p, "bucket", bucketRegion, err)
+	}
+
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(p.Bucket),
+		MaxKeys: aws.Int64(1),
+	}
+	if p.Prefix != "" {
+		input.Prefix = aws.String(strings.Trim(p.Prefix, "/") + "/")
+	}
+	_, err = client.ListObjectsV2(input)
+	if err != nil {
+		what := "bucket"
+		if p.Prefix != "" {
+			what = "prefix"
+		}
+		return preflightFailure(p, what, bucketRegion, err)
+	}
+	return nil
+}
+
+// preflightFailure tells apart the usual mistakes in volume parameters.
+// bucketRegion is the region S3 says the bucket is in, if it did.
+func preflightFailure(p params.Mount, what, bucketRegion string, err error) error {
+	failure := mountFailure{
+		errType: params.ErrBucketAccess,
+		message: fmt.Sprintf("unable to access bucket '%s'", p.Bucket),
+		err:     err,
+	}
+
+	reqErr, ok := err.(awserr.RequestFailure)
+	if !ok {
+		failure.message += ", check endpoint and network access"
+		return failure
+	}
+
+	switch {
+	case reqErr.StatusCode() == http.StatusForbidden:
+		failure.errType = params.ErrAccessDenied
+		if what == "prefix" {
+			failure.message = fmt.Sprintf("access denied to prefix '%s' in bucket '%s', check credentials and bucket policy", p.Prefix, p.Bucket)
+		} else {
+			failure.message = fmt.Sprintf("access denied to bucket '%s', check credentials and bucket policy", p.Bucket)
+		}
+	case reqErr.StatusCode() == http.StatusNotFound || reqErr.Code() == s3.ErrCodeNoSuchBucket:
+		failure.errType = params.ErrNoSuchBucket
+		failure.message = fmt.Sprintf("bucket '%s' does not exist", p.Bucket)
+	case isRedirect(err):
+		failure.errType = params.ErrWrongRegion
+		region := p.Region
+		if region == "" {
+			region = defaultRegion
+		}
+		failure.message = fmt.Sprintf("bucket '%s' is not in region '%s', check region", p.Bucket, region)
+		if bucketRegion != "" {
+			failure.message = fmt.Sprintf("bucket '%s' is in region '%s', not in region '%s'", p.Bucket, bucketRegion, region)
+		}
+	default:
+		failure.message += fmt.Sprintf(": %s", reqErr.Code())
+	}
+	return failure
+}
+
+// isRedirect is true for the errors S3 answers a request sent to the wrong
+// region with.
+func isRedirect(err error) bool {
+	reqErr, ok := err.(awserr.RequestFailure)
+	if !ok {
+		return false
+	}
+	return reqErr.StatusCode() == http.StatusMovedPermanently ||
+		reqErr.Code() == "AuthorizationHeaderMalformed" ||
+		reqErr.Code() == "PermanentRedirect" ||
+		reqErr.Code() == "IllegalLocationConstraintException"
+}
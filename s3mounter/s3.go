@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/kahing/goofys/api"
+	"github.com/orange-cloudfoundry/s3-volume-driver/params"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultRegion = "us-east-1"
+
+// newAWSConfig is the configuration goofys.Mount would build, with
+// credentials which may carry a session token and get refreshed.
+func newAWSConfig(p params.Mount) (*aws.Config, *sessionProvider, error) {
+	region := p.Region
+	if region == "" {
+		region = defaultRegion
+	}
+
+	tlsConfig, err := newTLSConfig(p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	awsConfig := (&aws.Config{
+		Region:           aws.String(region),
+		S3ForcePathStyle: aws.Bool(!p.Subdomain),
+		Logger:           goofys.GetLogger("s3"),
+	}).WithHTTPClient(&http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+				DualStack: true,
+			}).DialContext,
+			MaxIdleConns:          1000,
+			MaxIdleConnsPerHost:   1000,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 10 * time.Second,
+			TLSClientConfig:       tlsConfig,
+		},
+		Timeout: p.HTTPTimeout,
+	})
+
+	creds, provider, err := newCredentials(p, awsConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	awsConfig.Credentials = creds
+
+	if p.SSECKey != "" {
+		transport, err := newSSECTransport(awsConfig.HTTPClient.Transport, creds, p.SSECKey, p.Bucket, !p.Subdomain)
+		if err != nil {
+			return nil, nil, err
+		}
+		awsConfig.HTTPClient = &http.Client{Transport: transport, Timeout: awsConfig.HTTPClient.Timeout}
+	}
+
+	if p.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(p.Endpoint)
+	}
+	return awsConfig, provider, nil
+}
+
+// ensurePrefix creates the directory marker of the mounted prefix when the
+// prefix holds no object yet.
+func ensurePrefix(p params.Mount, awsConfig *aws.Config) error {
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return err
+	}
+	client := s3.New(sess)
+
+	marker := strings.Trim(p.Prefix, "/") + "/"
+	list, err := client.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:  aws.String(p.Bucket),
+		Prefix:  aws.String(marker),
+		MaxKeys: aws.Int64(1),
+	})
+	if err != nil {
+		return err
+	}
+	if len(list.Contents) > 0 {
+		return nil
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(p.Bucket),
+		Key:    aws.String(marker),
+		Body:   strings.NewReader(""),
+	}
+	if p.ACL != "" {
+		input.ACL = aws.String(p.ACL)
+	}
+	if p.StorageClass != "" {
+		input.StorageClass = aws.String(p.StorageClass)
+	}
+	if p.UseKMS {
+		input.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+		if p.KMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(p.KMSKeyID)
+		}
+	} else if p.UseSSE {
+		input.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAes256)
+	}
+
+	_, err = client.PutObject(input)
+	return err
+}
+
+// newTLSConfig trusts the system CAs, the CAs of the driver trusted CA
+// directory and the CA bundle of the volume.
+func newTLSConfig(p params.Mount) (*tls.Config, error) {
+	if p.InsecureSkipVerify {
+		log.Warn("Endpoint certificate verification is disabled")
+		return &tls.Config{InsecureSkipVerify: true}, nil
+	}
+	if p.TrustedCADir == "" && p.CACert == "" {
+		return nil, nil
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if p.TrustedCADir != "" {
+		files, err := ioutil.ReadDir(p.TrustedCADir)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read trusted CA directory: %v", err)
+		}
+		for _, file := range files {
+			if file.IsDir() {
+				continue
+			}
+			path := filepath.Join(p.TrustedCADir, file.Name())
+			pem, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read trusted CA %s: %v", path, err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				log.Warnf("No certificate found in trusted CA %s", path)
+			}
+		}
+	}
+
+	if p.CACert != "" && !pool.AppendCertsFromPEM([]byte(p.CACert)) {
+		return nil, errors.New("no certificate found in volume CA bundle")
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// checkCredentials makes sure creds give access to the mounted prefix, the
+// way goofys checks a bucket on mount: by looking up a random key which is
+// expected not to exist.
+func checkCredentials(p params.Mount, awsConfig *aws.Config, creds *credentials.Credentials) error {
+	checkConfig := awsConfig.Copy(&aws.Config{Credentials: creds})
+	if transport, ok := checkConfig.HTTPClient.Transport.(*sseCTransport); ok {
+		checkConfig.HTTPClient = &http.Client{Transport: transport.withCredentials(creds), Timeout: checkConfig.HTTPClient.Timeout}
+	}
+	sess, err := session.NewSession(checkConfig)
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("s3-volume-driver-credentials-check-%d", time.Now().UnixNano())
+	if p.Prefix != "" {
+		key = strings.Trim(p.Prefix, "/") + "/" + key
+	}
+	_, err = s3.New(sess).HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(p.Bucket),
+		Key:    aws.String(key),
+	})
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+func isAccessDenied(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() == http.StatusForbidden
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sseCAlgorithm         = "AES256"
+	sseCHeader            = "X-Amz-Server-Side-Encryption-Customer-"
+	sseCCopyHeader        = "X-Amz-Copy-Source-Server-Side-Encryption-Customer-"
+	v4AuthorizationPrefix = "AWS4-HMAC-SHA256 "
+)
+
+// sseCTransport adds the SSE-C customer key headers to the object requests
+// of goofys, which knows nothing about SSE-C. Headers added after signing
+// must be signed as well, so requests are signed again. Only V4 signing is
+// supported.
+type sseCTransport struct {
+	base      http.RoundTripper
+	signer    *v4.Signer
+	key       string
+	keyMD5    string
+	bucket    string
+	pathStyle bool
+}
+
+// newSSECTransport takes the base64 encoded customer key.
+func newSSECTransport(base http.RoundTripper, creds *credentials.Credentials, key, bucket string, pathStyle bool) (*sseCTransport, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) != 32 {
+		return nil, errors.New("SSE-C key must be 32 bytes encoded in base64")
+	}
+	sum := md5.Sum(raw)
+	return &sseCTransport{
+		base:      base,
+		signer:    newSSECSigner(creds),
+		key:       key,
+		keyMD5:    base64.StdEncoding.EncodeToString(sum[:]),
+		bucket:    bucket,
+		pathStyle: pathStyle,
+	}, nil
+}
+
+// withCredentials is the same transport signing with other credentials.
+func (t *sseCTransport) withCredentials(creds *credentials.Credentials) *sseCTransport {
+	clone := *t
+	clone.signer = newSSECSigner(creds)
+	return &clone
+}
+
+// newSSECSigner signs requests again without their body: it must not be
+// replaced with the nil body given to Sign, the payload hash set by the
+// first signing is reused.
+func newSSECSigner(creds *credentials.Credentials) *v4.Signer {
+	return v4.NewSigner(creds, func(s *v4.Signer) {
+		s.DisableRequestBodyOverwrite = true
+	})
+}
+
+func (t *sseCTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.needsKey(req) {
+		return t.base.RoundTrip(req)
+	}
+
+	authorization := req.Header.Get("Authorization")
+	if authorization == "" {
+		// anonymous requests cannot carry a customer key anyway
+		return t.base.RoundTrip(req)
+	}
+	region, ok := signingRegion(authorization)
+	if !ok {
+		return nil, errors.New("SSE-C requires V4 signing, the endpoint does not support it")
+	}
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		return nil, errors.New("SSE-C requires signed payloads")
+	}
+
+	// a RoundTripper must not modify the request it is given
+	signed := new(http.Request)
+	*signed = *req
+	signed.Header = make(http.Header, len(req.Header)+6)
+	for name, values := range req.Header {
+		signed.Header[name] = append([]string(nil), values...)
+	}
+	signed.Header.Del("Authorization")
+
+	t.setKey(signed.Header, sseCHeader)
+	if signed.Header.Get("X-Amz-Copy-Source") != "" {
+		t.setKey(signed.Header, sseCCopyHeader)
+	}
+
+	if _, err := t.signer.Sign(signed, nil, "s3", region, time.Now()); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(signed)
+}
+
+func (t *sseCTransport) setKey(header http.Header, prefix string) {
+	header.Set(prefix+"Algorithm", sseCAlgorithm)
+	header.Set(prefix+"Key", t.key)
+	header.Set(prefix+"Key-MD5", t.keyMD5)
+}
+
+// needsKey is true for the requests reading or writing object content:
+// GET, HEAD and PUT on an object, multipart upload creation and parts.
+func (t *sseCTransport) needsKey(req *http.Request) bool {
+	path := req.URL.Path
+	if t.pathStyle {
+		path = strings.TrimPrefix(path, "/"+t.bucket)
+	}
+	if strings.Trim(path, "/") == "" {
+		// bucket requests
+		return false
+	}
+
+	query := req.URL.Query()
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		// object content, not its parts listing, acl or tags
+		return len(query) == 0 || (len(query) == 1 && query.Get("versionId") != "")
+	case http.MethodPut:
+		// objects, copies and parts
+		return !hasAny(query, "acl", "tagging")
+	case http.MethodPost:
+		// multipart upload creation, not its completion
+		_, uploads := query["uploads"]
+		return uploads
+	}
+	return false
+}
+
+func hasAny(query map[string][]string, names ...string) bool {
+	for _, name := range names {
+		if _, ok := query[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// signingRegion reads the region from the credential scope of a V4
+// authorization header.
+func signingRegion(authorization string) (string, bool) {
+	if !strings.HasPrefix(authorization, v4AuthorizationPrefix) {
+		return "", false
+	}
+	for _, part := range strings.Split(strings.TrimPrefix(authorization, v4AuthorizationPrefix), ",") {
+		part = strings.TrimSpace(part)
+		if !strings.HasPrefix(part, "Credential=") {
+			continue
+		}
+		// Credential=AKID/date/region/service/aws4_request
+		scope := strings.Split(strings.TrimPrefix(part, "Credential="), "/")
+		if len(scope) != 5 {
+			return "", false
+		}
+		return scope[2], true
+	}
+	return "", false
+}
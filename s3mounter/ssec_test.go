@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordingTransport struct {
+	requests []*http.Request
+	bodies   []string
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := ""
+	if req.Body != nil {
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = string(data)
+	}
+	t.requests = append(t.requests, req)
+	t.bodies = append(t.bodies, body)
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+func TestSSECTransportKeepsSignedBody(t *testing.T) {
+	creds := credentials.NewStaticCredentials("AKID", "SECRET", "")
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+
+	for _, withCredentials := range []bool{false, true} {
+		base := &recordingTransport{}
+		transport, err := newSSECTransport(base, creds, key, "bucket", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if withCredentials {
+			transport = transport.withCredentials(credentials.NewStaticCredentials("AKID2", "SECRET2", ""))
+		}
+
+		content := "object content"
+		req, err := http.NewRequest(http.MethodPut, "https://bucket.s3.amazonaws.com/some/object", strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// as goofys requests are signed by the SDK before reaching the transport
+		body := bytes.NewReader([]byte(content))
+		if _, err := v4.NewSigner(creds).Sign(req, body, "s3", "eu-west-1", time.Now()); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := transport.RoundTrip(req); err != nil {
+			t.Fatal(err)
+		}
+		if len(base.requests) != 1 {
+			t.Fatalf("expected 1 request, got %d", len(base.requests))
+		}
+		sent := base.requests[0]
+		if base.bodies[0] != content {
+			t.Errorf("withCredentials=%t: expected body %q, got %q", withCredentials, content, base.bodies[0])
+		}
+		if sent.ContentLength != int64(len(content)) {
+			t.Errorf("withCredentials=%t: expected content length %d, got %d", withCredentials, len(content), sent.ContentLength)
+		}
+		if sent.Header.Get(sseCHeader+"Key") != key {
+			t.Errorf("withCredentials=%t: customer key header missing", withCredentials)
+		}
+		if !strings.Contains(sent.Header.Get("Authorization"), "x-amz-server-side-encryption-customer-key") {
+			t.Errorf("withCredentials=%t: customer key headers are not signed: %s", withCredentials, sent.Header.Get("Authorization"))
+		}
+	}
+}
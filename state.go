@@ -5,41 +5,55 @@ import (
 	"code.cloudfoundry.org/dockerdriver/driverhttp"
 	"code.cloudfoundry.org/lager"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+const remountConcurrency = 4
+
 func (d *S3Driver) restoreState(env dockerdriver.Env) {
 	logger := env.Logger().Session("restore-state")
 	logger.Info("start")
 	defer logger.Info("end")
 
-	stateFile := filepath.Join(d.mountPathRoot, "driver-state.json")
-
-	stateData, err := d.ioutil.ReadFile(stateFile)
+	// starting empty would overwrite the volumes which were not loaded
+	state, err := d.store.Load()
+	if err == errNewerState {
+		logger.Fatal("state-written-by-newer-driver", err)
+	}
 	if err != nil {
-		logger.Info("failed-to-read-state-file", lager.Data{"err": err, "stateFile": stateFile})
-		return
+		logger.Fatal("failed-to-load-state", err)
 	}
+	logger.Info("state-restored", lager.Data{"state": state})
 
-	state := map[string]*S3VolumeInfo{}
-	err = json.Unmarshal(stateData, &state)
-
-	logger.Info("state", lager.Data{"state": state})
-
-	if err != nil {
-		logger.Error("failed-to-unmarshall-state", err, lager.Data{"stateFile": stateFile})
-		return
+	for name, volume := range state {
+		rotated, err := d.unsealCredentials(name, volume)
+		if err != nil {
+			// the volume keeps its sealed credentials for a driver given the right key
+			logger.Error("failed-to-unseal-credentials", err, lager.Data{"volume": name})
+			volume.RestoreError = fmt.Sprintf("unable to unseal credentials: %s", err.Error())
+			continue
+		}
+		if rotated {
+			// persisting the volumes below seals them again with the current key
+			logger.Info("credentials-sealed-with-previous-key", lager.Data{"volume": name})
+		}
 	}
-	logger.Info("state-restored", lager.Data{"state-file": stateFile})
 
 	d.volumesLock.Lock()
 	d.volumes = state
 	d.volumesLock.Unlock()
 
 	logger.Info("remount-volumes-from-state", lager.Data{"state": state})
+	var toRemount []*S3VolumeInfo
 	for _, volume := range d.volumes {
-		if volume.MountCount == 0 {
+		if volume.MountCount == 0 || volume.SealedCredentials != "" {
 			continue
 		}
 		if volume.ConnectionInfo.Bucket == "" {
@@ -47,46 +61,268 @@ func (d *S3Driver) restoreState(env dockerdriver.Env) {
 			delete(d.volumes, volume.Name)
 			os.Remove(volume.Mountpoint)
 			d.volumesLock.Unlock()
+			if err := d.removeVolumeState(driverhttp.EnvWithLogger(logger, env), volume.Name); err != nil {
+				logger.Error("remove-volume-state-failed", err, lager.Data{"volume": volume.Name})
+			}
 			continue
 		}
+		toRemount = append(toRemount, volume)
 	}
-	d.volumesLock.Lock()
-	defer d.volumesLock.Unlock()
-	err = d.persistState(driverhttp.EnvWithLogger(logger, env))
+
+	for _, volume := range d.volumes {
+		if volume.SealedCredentials != "" {
+			continue
+		}
+		if err := d.persistVolume(driverhttp.EnvWithLogger(logger, env), volume); err != nil {
+			logger.Error("persist-volume-failed", err, lager.Data{"volume": volume.Name})
+		}
+	}
+
+	// remounts may take a mount timeout per volume, the driver must serve
+	// meanwhile; Mount waits for the remount of its volume on the volume lock
+	go d.remountVolumes(driverhttp.EnvWithLogger(logger, env), toRemount)
+}
+
+// remountVolumes brings back the mounts of volumes restored from state which
+// are no longer served by a mounter, at most remountConcurrency at a time.
+// Volumes which cannot be remounted keep their reference count so that the
+// next Mount retries, and the failure is recorded in RestoreError. Volumes
+// unmounted, removed or created again since the restore are left alone.
+func (d *S3Driver) remountVolumes(env dockerdriver.Env, volumes []*S3VolumeInfo) {
+	logger := env.Logger().Session("remount-volumes")
+	logger.Info("start", lager.Data{"count": len(volumes)})
+	defer logger.Info("end")
+
+	sem := make(chan struct{}, remountConcurrency)
+	var wg sync.WaitGroup
+	for _, volume := range volumes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(volume *S3VolumeInfo) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			unlock := d.volumeLocks.lock(volume.Name)
+			defer unlock()
+
+			volumeLogger := logger.Session("volume", lager.Data{"volume": volume.Name, "mountpoint": volume.Mountpoint})
+
+			d.volumesLock.RLock()
+			current := d.volumes[volume.Name] == volume && volume.MountCount > 0
+			d.volumesLock.RUnlock()
+			if !current {
+				volumeLogger.Info("volume-changed-since-restore")
+				return
+			}
+
+			err := d.remountVolume(driverhttp.EnvWithLogger(volumeLogger, env), volume)
+
+			d.volumesLock.Lock()
+			if err != nil {
+				volumeLogger.Error("remount-failed", err)
+				volume.RestoreError = err.Error()
+			} else {
+				volume.RestoreError = ""
+			}
+			d.volumesLock.Unlock()
+
+			if err := d.persistVolume(driverhttp.EnvWithLogger(volumeLogger, env), volume); err != nil {
+				volumeLogger.Error("persist-volume-failed", err)
+			}
+		}(volume)
+	}
+	wg.Wait()
+}
+
+func (d *S3Driver) remountVolume(env dockerdriver.Env, volume *S3VolumeInfo) error {
+	logger := env.Logger()
+
+	mounted, err := d.mountChecker.Exists(volume.Mountpoint)
 	if err != nil {
-		logger.Error("persist-state-failed", err)
+		return err
+	}
+
+	if mounted {
+		if d.check(env, volume.Name, volume.Mountpoint) {
+			logger.Info("volume-still-mounted")
+			d.adoptMounter(env, volume)
+			return nil
+		}
+	}
+
+	// a dead mounter leaves dead fuse mounts behind, on the mountpoint and
+	// on the cache backing mount of a cached volume
+	logger.Info("unmount-stale-mounts")
+	cacheDir := ""
+	if volume.ConnectionInfo.Cache && d.cache.enabled() {
+		cacheDir = d.cache.dir(volume.Name)
+	}
+	if err := d.unmountStaleMounts(env, volume.Mountpoint, cacheDir); err != nil {
+		return err
 	}
+
+	logger.Info("remount-volume")
+	return d.mount(env, volume.ConnectionInfo, volume.Mountpoint, volume.Name)
 }
 
-func (d *S3Driver) removeState(env dockerdriver.Env) {
-	logger := env.Logger().Session("remove-state")
+// persistVolume stores a volume with its credentials sealed.
+func (d *S3Driver) persistVolume(env dockerdriver.Env, volume *S3VolumeInfo) error {
+	logger := env.Logger().Session("persist-volume", lager.Data{"volume": volume.Name})
 	logger.Info("start")
 	defer logger.Info("end")
-	os.Remove(d.mountPath(env, "driver-state.json"))
+
+	sealed, err := d.sealCredentials(volume)
+	if err != nil {
+		logger.Error("failed-to-seal-credentials", err)
+		return err
+	}
+
+	if err := d.store.Put(sealed); err != nil {
+		logger.Error("failed-to-store-volume", err)
+		return err
+	}
+	return nil
 }
 
-func (d *S3Driver) persistState(env dockerdriver.Env) error {
-	logger := env.Logger().Session("persist-state")
+func (d *S3Driver) removeVolumeState(env dockerdriver.Env, name string) error {
+	logger := env.Logger().Session("remove-volume-state", lager.Data{"volume": name})
 	logger.Info("start")
 	defer logger.Info("end")
 
-	orig := d.osHelper.Umask(000)
-	defer d.osHelper.Umask(orig)
+	if err := d.store.Delete(name); err != nil {
+		logger.Error("failed-to-remove-volume", err)
+		return err
+	}
+	return nil
+}
+
+// volumeCredentials are the secrets of a ConnectionInfo which are never
+// written in clear to the state file.
+type volumeCredentials struct {
+	AccessKeyId     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	KMSKeyID        string `json:"kms_key_id"`
+	SessionToken    string `json:"session_token,omitempty"`
+	ExternalID      string `json:"external_id,omitempty"`
+	SSECKey         string `json:"sse_c_key,omitempty"`
+	HTTPProxy       string `json:"http_proxy,omitempty"`
+}
+
+func credentialsOf(connInfo ConnectionInfo) volumeCredentials {
+	return volumeCredentials{
+		AccessKeyId:     connInfo.AccessKeyId,
+		SecretAccessKey: connInfo.SecretAccessKey,
+		KMSKeyID:        connInfo.KMSKeyID,
+		SessionToken:    connInfo.SessionToken,
+		ExternalID:      connInfo.ExternalID,
+		SSECKey:         connInfo.SSECKey,
+		HTTPProxy:       connInfo.HTTPProxy,
+	}
+}
+
+func (c volumeCredentials) applyTo(connInfo *ConnectionInfo) {
+	connInfo.AccessKeyId = c.AccessKeyId
+	connInfo.SecretAccessKey = c.SecretAccessKey
+	connInfo.KMSKeyID = c.KMSKeyID
+	connInfo.SessionToken = c.SessionToken
+	connInfo.ExternalID = c.ExternalID
+	connInfo.SSECKey = c.SSECKey
+	connInfo.HTTPProxy = c.HTTPProxy
+}
 
-	stateFile := d.mountPath(env, "driver-state.json")
+// sealCredentials returns a copy of volume to persist, with its credentials
+// encrypted in SealedCredentials. Without a keyring credentials are dropped.
+// A volume still holding SealedCredentials could not be unsealed on restore,
+// they are kept as they are.
+func (d *S3Driver) sealCredentials(volume *S3VolumeInfo) (*S3VolumeInfo, error) {
+	sealed := *volume
+	if volume.SealedCredentials != "" || d.stateKeyring == nil {
+		return &sealed, nil
+	}
 
-	stateData, err := json.Marshal(d.volumes)
+	creds, err := json.Marshal(credentialsOf(volume.ConnectionInfo))
 	if err != nil {
-		logger.Error("failed-to-marshall-state", err)
-		return err
+		return nil, err
+	}
+	sealed.SealedCredentials, err = d.stateKeyring.Seal(volume.Name, creds)
+	if err != nil {
+		return nil, err
+	}
+	return &sealed, nil
+}
+
+// unsealCredentials opens the SealedCredentials of a restored volume, they
+// are cleared only once opened.
+func (d *S3Driver) unsealCredentials(name string, volume *S3VolumeInfo) (rotated bool, err error) {
+	sealed := volume.SealedCredentials
+	if sealed == "" {
+		return false, nil
+	}
+	if d.stateKeyring == nil {
+		return false, errors.New("credentials are sealed but no state key is configured")
 	}
 
-	err = d.ioutil.WriteFile(stateFile, stateData, os.ModePerm)
+	plaintext, rotated, err := d.stateKeyring.Open(name, sealed)
 	if err != nil {
-		logger.Error("failed-to-write-state-file", err, lager.Data{"stateFile": stateFile})
-		return err
+		return false, err
 	}
 
-	logger.Debug("state-saved", lager.Data{"state-file": stateFile})
-	return nil
+	var creds volumeCredentials
+	if err := json.Unmarshal(plaintext, &creds); err != nil {
+		return false, err
+	}
+	creds.applyTo(&volume.ConnectionInfo)
+	volume.SealedCredentials = ""
+	return rotated, nil
+}
+
+// adoptMounter puts the mounter of a volume which survived a driver restart
+// under supervision, so that it is respawned when it dies. A mounter which
+// cannot be found is left unsupervised, and listed without its mounter.
+func (d *S3Driver) adoptMounter(env dockerdriver.Env, volume *S3VolumeInfo) {
+	logger := env.Logger().Session("adopt-mounter")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	// the mounter still uses its cache, supervised or not
+	cacheDir, cacheSize := d.reserveCache(logger, volume.Name, volume.ConnectionInfo)
+
+	p, err := d.mountParams(logger, volume.ConnectionInfo, volume.Name)
+	if err != nil {
+		logger.Error("mounter-unsupervised", err)
+		return
+	}
+
+	pid, err := d.findMounter(volume.Name)
+	if err != nil {
+		logger.Error("mounter-unsupervised", err)
+		return
+	}
+	p.MountPoint = volume.Mountpoint
+	p.CacheDir, p.CacheSize = cacheDir, cacheSize
+
+	logger.Info("mounter-adopted", lager.Data{"pid": pid})
+	d.supervisor.supervise(adoptMounterProcess(volume.Name, p, pid, time.Now()))
+}
+
+// findMounter returns the pid of the s3mounter of a volume, as started by
+// mounterCommand.
+func (d *S3Driver) findMounter(volumeName string) (int, error) {
+	cmdlines, err := d.filepath.Glob("/proc/[0-9]*/cmdline")
+	if err != nil {
+		return 0, err
+	}
+	for _, cmdline := range cmdlines {
+		contents, err := d.ioutil.ReadFile(cmdline)
+		if err != nil {
+			// the process exited meanwhile
+			continue
+		}
+		args := strings.Split(strings.TrimSuffix(string(contents), "\x00"), "\x00")
+		if len(args) != 2 || args[0] != d.mounterPath || args[1] != volumeName {
+			continue
+		}
+		return strconv.Atoi(filepath.Base(filepath.Dir(cmdline)))
+	}
+	return 0, fmt.Errorf("no mounter process found for volume %s", volumeName)
 }
@@ -0,0 +1,279 @@
+package s3driver
+
+import (
+	"code.cloudfoundry.org/goshims/filepathshim"
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/goshims/timeshim"
+	"code.cloudfoundry.org/lager"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+const (
+	stateFileName = "driver-state.json"
+	// stateVersion is the schema version of the state files written. Version
+	// 1 files are the bare volume map written before versioning.
+	stateVersion = 2
+)
+
+// stateFile is the content of driver-state.json.
+type stateFile struct {
+	Version int                      `json:"version"`
+	Volumes map[string]*S3VolumeInfo `json:"volumes"`
+}
+
+// stateMigrations upgrade a state file of a version to the next one.
+var stateMigrations = map[int]func(data []byte) ([]byte, error){
+	1: func(data []byte) ([]byte, error) {
+		volumes := map[string]json.RawMessage{}
+		if err := json.Unmarshal(data, &volumes); err != nil {
+			return nil, err
+		}
+		return json.Marshal(struct {
+			Version int                        `json:"version"`
+			Volumes map[string]json.RawMessage `json:"volumes"`
+		}{Version: 2, Volumes: volumes})
+	},
+}
+
+// errNewerState is returned for state files written by a newer driver,
+// which this one must not overwrite with what it understands of them.
+var errNewerState = errors.New("state file was written by a newer driver")
+
+// parseState reads a state file of any known version. It returns the
+// version the file was written with.
+func parseState(data []byte) (map[string]*S3VolumeInfo, int, error) {
+	header := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, 0, err
+	}
+
+	version := 1
+	// a version 1 file may hold a volume named 'version', but as an object
+	if raw, ok := header["version"]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			version = 1
+		}
+	}
+	if version > stateVersion {
+		return nil, version, errNewerState
+	}
+	originalVersion := version
+
+	for version < stateVersion {
+		migrate, ok := stateMigrations[version]
+		if !ok {
+			return nil, originalVersion, fmt.Errorf("no migration from state version %d", version)
+		}
+		var err error
+		data, err = migrate(data)
+		if err != nil {
+			return nil, originalVersion, fmt.Errorf("migrating state version %d failed: %s", version, err.Error())
+		}
+		version++
+	}
+
+	state := stateFile{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, originalVersion, err
+	}
+	if state.Volumes == nil {
+		state.Volumes = map[string]*S3VolumeInfo{}
+	}
+	return state.Volumes, originalVersion, nil
+}
+
+// jsonStateStore keeps every volume in a single JSON file, rewritten as a
+// whole on each change.
+type jsonStateStore struct {
+	logger   lager.Logger
+	path     string
+	os       osshim.Os
+	filepath filepathshim.Filepath
+	ioutil   ioutilshim.Ioutil
+	time     timeshim.Time
+
+	lock    sync.Mutex
+	volumes map[string]*S3VolumeInfo
+	// loaded is set once the state file was read, quarantined or found
+	// missing: a file which was not loaded is never overwritten
+	loaded bool
+}
+
+func newJSONStateStore(logger lager.Logger, path string, os osshim.Os, filepath filepathshim.Filepath, ioutil ioutilshim.Ioutil, time timeshim.Time) *jsonStateStore {
+	return &jsonStateStore{
+		logger:   logger.Session("json-state-store", lager.Data{"stateFile": path}),
+		path:     path,
+		os:       os,
+		filepath: filepath,
+		ioutil:   ioutil,
+		time:     time,
+		volumes:  map[string]*S3VolumeInfo{},
+	}
+}
+
+// Load reads the state file, migrating it from older versions. A state file
+// which cannot be parsed is quarantined, and the store starts empty. A state
+// file of a newer driver fails with errNewerState, and a state file which
+// cannot be read fails as well.
+func (s *jsonStateStore) Load() (map[string]*S3VolumeInfo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.removeStaleTempFiles()
+
+	data, err := s.ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.logger.Info("no-state-file")
+			s.loaded = true
+			return map[string]*S3VolumeInfo{}, nil
+		}
+		return nil, fmt.Errorf("unable to read state file: %s", err.Error())
+	}
+
+	volumes, version, err := parseState(data)
+	if err == errNewerState {
+		// left untouched for the driver which wrote it
+		return nil, err
+	}
+	if err != nil {
+		quarantined, qErr := s.quarantine()
+		if qErr != nil {
+			return nil, fmt.Errorf("unable to quarantine state file (%s): %s", err.Error(), qErr.Error())
+		}
+		s.logger.Error("state-file-quarantined", err, lager.Data{"quarantined": quarantined, "version": version})
+		s.loaded = true
+		return map[string]*S3VolumeInfo{}, nil
+	}
+	if version != stateVersion {
+		s.logger.Info("state-file-migrated", lager.Data{"from-version": version, "to-version": stateVersion})
+	}
+
+	s.volumes = volumes
+	s.loaded = true
+	result := make(map[string]*S3VolumeInfo, len(volumes))
+	for name, volume := range volumes {
+		loaded := *volume
+		result[name] = &loaded
+	}
+	return result, nil
+}
+
+func (s *jsonStateStore) Get(name string) (*S3VolumeInfo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	volume, ok := s.volumes[name]
+	if !ok {
+		return nil, errVolumeNotStored
+	}
+	stored := *volume
+	return &stored, nil
+}
+
+func (s *jsonStateStore) Put(volume *S3VolumeInfo) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stored := *volume
+	return s.update(func(volumes map[string]*S3VolumeInfo) {
+		volumes[volume.Name] = &stored
+	})
+}
+
+func (s *jsonStateStore) Delete(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.volumes[name]; !ok {
+		return nil
+	}
+	return s.update(func(volumes map[string]*S3VolumeInfo) {
+		delete(volumes, name)
+	})
+}
+
+// update writes the state file with the change applied, and keeps it in
+// memory only once written.
+func (s *jsonStateStore) update(change func(map[string]*S3VolumeInfo)) error {
+	if !s.loaded {
+		return errors.New("state file was not loaded, it is not overwritten")
+	}
+
+	volumes := make(map[string]*S3VolumeInfo, len(s.volumes)+1)
+	for name, volume := range s.volumes {
+		volumes[name] = volume
+	}
+	change(volumes)
+
+	data, err := json.Marshal(stateFile{Version: stateVersion, Volumes: volumes})
+	if err != nil {
+		return err
+	}
+	if err := s.write(data); err != nil {
+		return err
+	}
+	s.volumes = volumes
+	return nil
+}
+
+// write replaces the state file with data atomically: data goes to a
+// temporary file which is synced, then renamed over it. A crash leaves
+// either the previous or the new state, never a truncated one.
+func (s *jsonStateStore) write(data []byte) error {
+	dir := filepath.Dir(s.path)
+	tmp, err := s.ioutil.TempFile(dir, stateFileName+".tmp-")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = syscall.Fsync(int(tmp.Fd()))
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = s.os.Chmod(tmpPath, 0600)
+	}
+	if err == nil {
+		err = s.os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		s.os.Remove(tmpPath)
+		return err
+	}
+
+	// make the rename itself durable
+	dirFile, err := s.os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dirFile.Close()
+	return syscall.Fsync(int(dirFile.Fd()))
+}
+
+// quarantine moves away a state file which cannot be restored, so that it
+// is kept for investigation and not overwritten.
+func (s *jsonStateStore) quarantine() (string, error) {
+	quarantined := fmt.Sprintf("%s.quarantined-%d", s.path, s.time.Now().Unix())
+	return quarantined, s.os.Rename(s.path, quarantined)
+}
+
+// removeStaleTempFiles removes the temporary files left by a crash while
+// writing the state.
+func (s *jsonStateStore) removeStaleTempFiles() {
+	tmpFiles, _ := s.filepath.Glob(filepath.Join(filepath.Dir(s.path), stateFileName+".tmp-*"))
+	for _, tmpFile := range tmpFiles {
+		s.os.Remove(tmpFile)
+	}
+}
@@ -0,0 +1,76 @@
+package s3driver
+
+import (
+	"code.cloudfoundry.org/dockerdriver"
+	"code.cloudfoundry.org/goshims/filepathshim"
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/goshims/timeshim"
+	"code.cloudfoundry.org/lager"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestJSONStateStore(t *testing.T) (*jsonStateStore, string) {
+	dir, err := ioutil.TempDir("", "s3driver-state-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newJSONStateStore(
+		lager.NewLogger("s3driver-test"),
+		filepath.Join(dir, stateFileName),
+		&osshim.OsShim{},
+		&filepathshim.FilepathShim{},
+		&ioutilshim.IoutilShim{},
+		&timeshim.TimeShim{},
+	)
+	return store, dir
+}
+
+// TestUnreadableStateFileIsNotOverwritten fails to load a state file which
+// cannot be read, and keeps it.
+func TestUnreadableStateFileIsNotOverwritten(t *testing.T) {
+	store, dir := newTestJSONStateStore(t)
+	defer os.RemoveAll(dir)
+
+	// reading a directory fails with EISDIR
+	if err := os.Mkdir(store.path, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(); err == nil {
+		t.Fatal("an unreadable state file was loaded")
+	}
+	if err := store.Put(&S3VolumeInfo{VolumeInfo: dockerdriver.VolumeInfo{Name: "volume"}}); err == nil {
+		t.Error("a state file which was not loaded was overwritten")
+	}
+	if info, err := os.Stat(store.path); err != nil || !info.IsDir() {
+		t.Error("the state file was replaced")
+	}
+}
+
+// TestCorruptStateFileIsQuarantined starts empty from a state file which
+// cannot be parsed, and keeps it aside.
+func TestCorruptStateFileIsQuarantined(t *testing.T) {
+	store, dir := newTestJSONStateStore(t)
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(store.path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	volumes, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 0 {
+		t.Errorf("expected no volume, got %d", len(volumes))
+	}
+	quarantined, _ := filepath.Glob(store.path + ".quarantined-*")
+	if len(quarantined) != 1 {
+		t.Fatalf("expected a quarantined state file, got %v", quarantined)
+	}
+	if err := store.Put(&S3VolumeInfo{VolumeInfo: dockerdriver.VolumeInfo{Name: "volume"}}); err != nil {
+		t.Error(err)
+	}
+}
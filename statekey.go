@@ -0,0 +1,124 @@
+package s3driver
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const stateKeySize = 32
+
+// StateKeyring seals the volume credentials persisted in driver-state.json
+// with AES-GCM. The first key is used to seal, every key is tried to open so
+// a state file written before a key rotation can still be restored.
+type StateKeyring struct {
+	keys []stateKey
+}
+
+type stateKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// LoadStateKeyring reads the current key and any previous keys from files.
+// A key file holds 32 bytes encoded in hex or base64.
+func LoadStateKeyring(currentKeyFile string, previousKeyFiles []string) (*StateKeyring, error) {
+	var keys [][]byte
+	for _, keyFile := range append([]string{currentKeyFile}, previousKeyFiles...) {
+		key, err := readStateKey(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return NewStateKeyring(keys...)
+}
+
+func NewStateKeyring(keys ...[]byte) (*StateKeyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one state key is required")
+	}
+
+	keyring := &StateKeyring{}
+	for _, key := range keys {
+		if len(key) != stateKeySize {
+			return nil, fmt.Errorf("state key must be %d bytes long, got %d", stateKeySize, len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(key)
+		keyring.keys = append(keyring.keys, stateKey{id: hex.EncodeToString(sum[:4]), aead: aead})
+	}
+	return keyring, nil
+}
+
+// Seal encrypts plaintext with the current key. The volume name is bound to
+// the ciphertext so sealed credentials cannot be swapped between volumes.
+func (k *StateKeyring) Seal(volumeName string, plaintext []byte) (string, error) {
+	key := k.keys[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := key.aead.Seal(nonce, nonce, plaintext, []byte(volumeName))
+	return key.id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value produced by Seal. rotated is true when the value was
+// sealed with a previous key and should be sealed again.
+func (k *StateKeyring) Open(volumeName, sealed string) (plaintext []byte, rotated bool, err error) {
+	parts := strings.SplitN(sealed, ":", 2)
+	if len(parts) != 2 {
+		return nil, false, errors.New("malformed sealed value")
+	}
+	data, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, false, err
+	}
+
+	for i, key := range k.keys {
+		if key.id != parts[0] {
+			continue
+		}
+		if len(data) < key.aead.NonceSize() {
+			return nil, false, errors.New("malformed sealed value")
+		}
+		nonce, ciphertext := data[:key.aead.NonceSize()], data[key.aead.NonceSize():]
+		plaintext, err := key.aead.Open(nil, nonce, ciphertext, []byte(volumeName))
+		if err != nil {
+			return nil, false, err
+		}
+		return plaintext, i > 0, nil
+	}
+	return nil, false, fmt.Errorf("no state key with id %s", parts[0])
+}
+
+func readStateKey(keyFile string) ([]byte, error) {
+	content, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	encoded := strings.TrimSpace(string(content))
+
+	if key, err := hex.DecodeString(encoded); err == nil && len(key) == stateKeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(encoded); err == nil && len(key) == stateKeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("state key file %s must contain %d bytes encoded in hex or base64", keyFile, stateKeySize)
+}
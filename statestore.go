@@ -0,0 +1,109 @@
+package s3driver
+
+import (
+	"code.cloudfoundry.org/lager"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// StateStoreJSON keeps the state in driver-state.json.
+	StateStoreJSON = "json"
+	// StateStoreBolt keeps the state in an embedded transactional key-value
+	// store, driver-state.db.
+	StateStoreBolt = "bolt"
+)
+
+// StateStore persists the volumes of the driver across its restarts. The
+// volumes it is given have their credentials sealed already.
+type StateStore interface {
+	// Load returns every volume stored.
+	Load() (map[string]*S3VolumeInfo, error)
+	Get(name string) (*S3VolumeInfo, error)
+	Put(volume *S3VolumeInfo) error
+	Delete(name string) error
+}
+
+var errVolumeNotStored = errors.New("volume not stored")
+
+// openStateStore opens the store of the given kind under the mount root. The
+// bolt store imports the JSON state file the first time it is used.
+func (d *S3Driver) openStateStore(logger lager.Logger, kind string) (StateStore, error) {
+	logger = logger.Session("open-state-store", lager.Data{"kind": kind})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	// the stores live in the mount root, which is created on first use
+	if err := d.os.MkdirAll(d.mountPathRoot, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	jsonStore := newJSONStateStore(logger, filepath.Join(d.mountPathRoot, stateFileName), d.os, d.filepath, d.ioutil, d.time)
+
+	switch kind {
+	case "", StateStoreJSON:
+		return jsonStore, nil
+	case StateStoreBolt:
+		store, err := openBoltStateStore(logger, filepath.Join(d.mountPathRoot, boltStateFileName))
+		if err != nil {
+			return nil, err
+		}
+		// starting without the volumes of the JSON state file would lose them
+		if err := d.importJSONState(logger, jsonStore, store); err != nil {
+			logger.Error("failed-to-import-json-state", err)
+			store.db.Close()
+			return nil, err
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown state store '%s'", kind)
+	}
+}
+
+// importJSONState moves the volumes of the JSON state file into an empty
+// bolt store, and renames the file aside so that it is imported once. A
+// volume which cannot be read back leaves the file in place.
+func (d *S3Driver) importJSONState(logger lager.Logger, jsonStore *jsonStateStore, store *boltStateStore) error {
+	if _, err := d.os.Stat(jsonStore.path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	empty, err := store.empty()
+	if err != nil {
+		return err
+	}
+	if !empty {
+		logger.Info("json-state-file-ignored", lager.Data{"stateFile": jsonStore.path})
+		return nil
+	}
+
+	volumes, err := jsonStore.Load()
+	if err != nil {
+		return err
+	}
+	if err := store.putAll(volumes); err != nil {
+		return err
+	}
+	// the file is only set aside once every volume reads back
+	for name := range volumes {
+		if _, err := store.Get(name); err != nil {
+			return fmt.Errorf("imported volume %s cannot be read back: %s", name, err.Error())
+		}
+	}
+	if _, err := d.os.Stat(jsonStore.path); os.IsNotExist(err) {
+		// it could not be parsed and was quarantined
+		return nil
+	}
+
+	imported := jsonStore.path + ".imported"
+	if err := d.os.Rename(jsonStore.path, imported); err != nil {
+		return err
+	}
+	logger.Info("json-state-file-imported", lager.Data{"volumes": len(volumes), "stateFile": imported})
+	return nil
+}
@@ -0,0 +1,101 @@
+package s3driver
+
+import (
+	"code.cloudfoundry.org/dockerdriver"
+	"code.cloudfoundry.org/goshims/filepathshim"
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/goshims/timeshim"
+	"code.cloudfoundry.org/lager"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newStateStoreTestDriver(t *testing.T) (*S3Driver, string) {
+	dir, err := ioutil.TempDir("", "s3driver-state-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &S3Driver{
+		os:            &osshim.OsShim{},
+		filepath:      &filepathshim.FilepathShim{},
+		ioutil:        &ioutilshim.IoutilShim{},
+		time:          &timeshim.TimeShim{},
+		mountPathRoot: dir,
+	}, dir
+}
+
+// TestBoltStoreFailsOnNewerJSONState does not open a bolt store without the
+// volumes of a JSON state file it cannot import.
+func TestBoltStoreFailsOnNewerJSONState(t *testing.T) {
+	d, dir := newStateStoreTestDriver(t)
+	defer os.RemoveAll(dir)
+
+	statePath := filepath.Join(dir, stateFileName)
+	if err := ioutil.WriteFile(statePath, []byte(`{"version": 99, "volumes": {}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.openStateStore(lager.NewLogger("s3driver-test"), StateStoreBolt); err != errNewerState {
+		t.Fatalf("expected errNewerState, got %v", err)
+	}
+	if _, err := os.Stat(statePath); err != nil {
+		t.Error("the JSON state file was moved")
+	}
+}
+
+// TestBoltStoreFailsOnUnreadableJSONState does the same for a JSON state
+// file which cannot be read.
+func TestBoltStoreFailsOnUnreadableJSONState(t *testing.T) {
+	d, dir := newStateStoreTestDriver(t)
+	defer os.RemoveAll(dir)
+
+	// reading a directory fails with EISDIR
+	if err := os.Mkdir(filepath.Join(dir, stateFileName), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.openStateStore(lager.NewLogger("s3driver-test"), StateStoreBolt); err == nil {
+		t.Fatal("the bolt store was opened")
+	}
+}
+
+// TestBoltStoreImportsJSONState moves the volumes of the JSON state file into
+// the bolt store, once.
+func TestBoltStoreImportsJSONState(t *testing.T) {
+	d, dir := newStateStoreTestDriver(t)
+	defer os.RemoveAll(dir)
+
+	jsonStore, err := d.openStateStore(lager.NewLogger("s3driver-test"), StateStoreJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jsonStore.Load(); err != nil {
+		t.Fatal(err)
+	}
+	volume := &S3VolumeInfo{VolumeInfo: dockerdriver.VolumeInfo{Name: "volume", MountCount: 1}}
+	if err := jsonStore.Put(volume); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := jsonStore.Get("volume"); err != nil || stored.MountCount != 1 {
+		t.Fatalf("expected the stored volume, got %+v, %v", stored, err)
+	}
+
+	store, err := d.openStateStore(lager.NewLogger("s3driver-test"), StateStoreBolt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := store.Get("volume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.MountCount != 1 {
+		t.Errorf("imported volume has mount count %d, expected 1", stored.MountCount)
+	}
+	if _, err := store.Get("other"); err != errVolumeNotStored {
+		t.Errorf("expected errVolumeNotStored, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, stateFileName+".imported")); err != nil {
+		t.Error("the JSON state file was not set aside")
+	}
+}
@@ -0,0 +1,361 @@
+package s3driver
+
+import (
+	"code.cloudfoundry.org/lager"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/orange-cloudfoundry/s3-volume-driver/driveradmin"
+	"github.com/orange-cloudfoundry/s3-volume-driver/params"
+	"net"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	mounterMinBackoff = 1 * time.Second
+	mounterMaxBackoff = 2 * time.Minute
+	// a mounter running longer than this is considered healthy and its
+	// restart backoff is reset
+	mounterStableRunTime = 5 * time.Minute
+	// an adopted mounter is not a child of the driver, it is polled
+	adoptedMounterPollInterval = 1 * time.Second
+)
+
+// mounterProcess is a running s3mounter child. It is reaped as soon as it
+// exits, exited is closed afterwards and the exit fields can then be read.
+type mounterProcess struct {
+	volumeName string
+	cmd        *exec.Cmd
+	pid        int
+	startedAt  time.Time
+	// adopted is set on a mounter which survived a driver restart
+	adopted bool
+
+	// controlLock serializes control requests and guards params, which
+	// follow the credentials rotated into the mounter
+	controlLock sync.Mutex
+	control     net.Conn
+	decoder     *json.Decoder
+	params      params.Mount
+
+	exited     chan struct{}
+	exitedAt   time.Time
+	exitStatus string
+}
+
+func newMounterProcess(volumeName string, p params.Mount, cmd *exec.Cmd, control net.Conn, startedAt time.Time) *mounterProcess {
+	proc := &mounterProcess{
+		volumeName: volumeName,
+		params:     p,
+		cmd:        cmd,
+		pid:        cmd.Process.Pid,
+		startedAt:  startedAt,
+		control:    control,
+		decoder:    json.NewDecoder(control),
+		exited:     make(chan struct{}),
+	}
+
+	go func() {
+		err := cmd.Wait()
+		control.Close()
+		proc.exitedAt = time.Now()
+		if cmd.ProcessState != nil {
+			proc.exitStatus = cmd.ProcessState.String()
+		} else {
+			proc.exitStatus = err.Error()
+		}
+		close(proc.exited)
+	}()
+
+	return proc
+}
+
+// adoptMounterProcess watches a mounter which survived a driver restart. Its
+// control socket was closed with the previous driver, and its exit status is
+// unknown.
+func adoptMounterProcess(volumeName string, p params.Mount, pid int, adoptedAt time.Time) *mounterProcess {
+	proc := &mounterProcess{
+		volumeName: volumeName,
+		params:     p,
+		pid:        pid,
+		startedAt:  adoptedAt,
+		adopted:    true,
+		exited:     make(chan struct{}),
+	}
+
+	go func() {
+		for syscall.Kill(pid, 0) != syscall.ESRCH {
+			time.Sleep(adoptedMounterPollInterval)
+		}
+		proc.exitedAt = time.Now()
+		proc.exitStatus = "adopted mounter exited"
+		close(proc.exited)
+	}()
+
+	return proc
+}
+
+func (proc *mounterProcess) mountParams() params.Mount {
+	proc.controlLock.Lock()
+	defer proc.controlLock.Unlock()
+
+	return proc.params
+}
+
+// rotateCredentials pushes creds into the running mounter, which checks
+// them against the bucket before using them. A respawned mounter gets them
+// as well.
+func (proc *mounterProcess) rotateCredentials(creds params.Credentials, timeout time.Duration) error {
+	proc.controlLock.Lock()
+	defer proc.controlLock.Unlock()
+
+	if proc.adopted {
+		return errors.New("mounter survived a driver restart and has no control socket, remount the volume to rotate its credentials")
+	}
+	if proc.decoder == nil {
+		return errors.New("mounter control socket is closed")
+	}
+
+	proc.control.SetDeadline(time.Now().Add(timeout))
+	defer proc.control.SetDeadline(time.Time{})
+
+	var response params.ControlResponse
+	err := json.NewEncoder(proc.control).Encode(params.ControlRequest{RotateCredentials: &creds})
+	if err == nil {
+		err = proc.decoder.Decode(&response)
+	}
+	if err != nil {
+		// the stream may be left in the middle of a message
+		proc.control.Close()
+		proc.decoder = nil
+		return fmt.Errorf("mounter did not answer: %s", err.Error())
+	}
+	if response.Error != "" {
+		return errors.New(response.Error)
+	}
+
+	proc.params.AccessKeyId = creds.AccessKeyId
+	proc.params.SecretAccessKey = creds.SecretAccessKey
+	proc.params.SessionToken = creds.SessionToken
+	proc.params.SessionTokenExpiration = creds.SessionTokenExpiration
+	return nil
+}
+
+type supervisedMounter struct {
+	process  *mounterProcess
+	restarts int
+	stopping bool
+}
+
+// mounterSupervisor watches the s3mounter of each mounted volume. When a
+// mounter dies without being asked to, the dead mountpoint is unmounted and
+// a new mounter is spawned with an exponential backoff. The volume lock is
+// held while doing so, so that a Mount does not start another mounter on the
+// same mountpoint meanwhile.
+type mounterSupervisor struct {
+	logger     lager.Logger
+	spawn      func(volumeName string, p params.Mount) (*mounterProcess, error)
+	cleanup    func(p params.Mount) error
+	lockVolume func(volumeName string) func()
+
+	lock     sync.Mutex
+	mounters map[string]*supervisedMounter
+}
+
+func newMounterSupervisor(
+	logger lager.Logger,
+	spawn func(volumeName string, p params.Mount) (*mounterProcess, error),
+	cleanup func(p params.Mount) error,
+	lockVolume func(volumeName string) func(),
+) *mounterSupervisor {
+	return &mounterSupervisor{
+		logger:     logger.Session("mounter-supervisor"),
+		spawn:      spawn,
+		cleanup:    cleanup,
+		lockVolume: lockVolume,
+		mounters:   map[string]*supervisedMounter{},
+	}
+}
+
+// supervise starts watching proc. A mounter previously supervised for the
+// same volume is left alone and will not be restarted anymore.
+func (s *mounterSupervisor) supervise(proc *mounterProcess) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if previous, ok := s.mounters[proc.volumeName]; ok {
+		previous.stopping = true
+	}
+	m := &supervisedMounter{process: proc}
+	s.mounters[proc.volumeName] = m
+
+	s.logger.Info("supervising-mounter", lager.Data{"volume": proc.volumeName, "pid": proc.pid})
+	go s.watch(m)
+}
+
+// stop tells the supervisor the volume mounter is about to exit on purpose.
+func (s *mounterSupervisor) stop(volumeName string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if m, ok := s.mounters[volumeName]; ok {
+		m.stopping = true
+	}
+}
+
+// resume cancels a stop when the volume could not be unmounted after all.
+func (s *mounterSupervisor) resume(volumeName string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if m, ok := s.mounters[volumeName]; ok {
+		m.stopping = false
+	}
+}
+
+func (s *mounterSupervisor) stopAll() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, m := range s.mounters {
+		m.stopping = true
+	}
+}
+
+// process returns the running mounter of a volume, if any.
+func (s *mounterSupervisor) process(volumeName string) (*mounterProcess, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	m, ok := s.mounters[volumeName]
+	if !ok || m.stopping {
+		return nil, false
+	}
+	return m.process, true
+}
+
+// info returns the running mounter of a volume, if any.
+func (s *mounterSupervisor) info(volumeName string) (driveradmin.MounterInfo, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	m, ok := s.mounters[volumeName]
+	if !ok || m.stopping {
+		return driveradmin.MounterInfo{}, false
+	}
+	return driveradmin.MounterInfo{
+		Pid:       m.process.pid,
+		StartedAt: m.process.startedAt,
+		Restarts:  m.restarts,
+		Adopted:   m.process.adopted,
+	}, true
+}
+
+func (s *mounterSupervisor) isStopping(m *supervisedMounter) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return m.stopping || s.mounters[m.process.volumeName] != m
+}
+
+func (s *mounterSupervisor) forget(m *supervisedMounter) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.mounters[m.process.volumeName] == m {
+		delete(s.mounters, m.process.volumeName)
+	}
+}
+
+func (s *mounterSupervisor) watch(m *supervisedMounter) {
+	backoff := mounterMinBackoff
+	for {
+		proc := m.process
+		<-proc.exited
+
+		logger := s.logger.Session("watch", lager.Data{
+			"volume":      proc.volumeName,
+			"pid":         proc.pid,
+			"started-at":  proc.startedAt,
+			"exited-at":   proc.exitedAt,
+			"exit-status": proc.exitStatus,
+		})
+
+		mountParams := proc.mountParams()
+		if !s.cleanupDead(logger, m, mountParams) {
+			logger.Info("mounter-exited")
+			s.forget(m)
+			return
+		}
+
+		logger.Error("mounter-died", errors.New(proc.exitStatus))
+		if proc.exitedAt.Sub(proc.startedAt) > mounterStableRunTime {
+			backoff = mounterMinBackoff
+		}
+
+		for {
+			logger.Info("respawn-mounter-after-backoff", lager.Data{"backoff": backoff.String()})
+			<-time.After(backoff)
+			backoff *= 2
+			if backoff > mounterMaxBackoff {
+				backoff = mounterMaxBackoff
+			}
+
+			respawned, err := s.respawn(logger, m, mountParams)
+			if err != nil {
+				logger.Error("respawn-mounter-failed", err)
+				continue
+			}
+			if !respawned {
+				logger.Info("respawn-cancelled")
+				s.forget(m)
+				return
+			}
+			break
+		}
+	}
+}
+
+// cleanupDead unmounts the mountpoint and cache backing mount of a mounter
+// which died, unless the volume was unmounted or mounted again meanwhile. It
+// returns false then.
+func (s *mounterSupervisor) cleanupDead(logger lager.Logger, m *supervisedMounter, mountParams params.Mount) bool {
+	unlock := s.lockVolume(m.process.volumeName)
+	defer unlock()
+
+	if s.isStopping(m) {
+		return false
+	}
+	if err := s.cleanup(mountParams); err != nil {
+		logger.Error("cleanup-stale-mountpoint-failed", err)
+	}
+	return true
+}
+
+// respawn starts a new mounter in place of the dead one, unless the volume
+// was unmounted or mounted again meanwhile. It returns false then.
+func (s *mounterSupervisor) respawn(logger lager.Logger, m *supervisedMounter, mountParams params.Mount) (bool, error) {
+	volumeName := m.process.volumeName
+	unlock := s.lockVolume(volumeName)
+	defer unlock()
+
+	if s.isStopping(m) {
+		return false, nil
+	}
+
+	newProc, err := s.spawn(volumeName, mountParams)
+	if err != nil {
+		return false, err
+	}
+
+	s.lock.Lock()
+	m.process = newProc
+	m.restarts++
+	s.lock.Unlock()
+
+	logger.Info("mounter-respawned", lager.Data{"new-pid": newProc.pid, "restarts": m.restarts})
+	return true, nil
+}
@@ -0,0 +1,53 @@
+package s3driver
+
+import (
+	"github.com/orange-cloudfoundry/s3-volume-driver/params"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// TestAdoptMounter finds a mounter left by a previous driver by its command
+// line, and notices when it exits.
+func TestAdoptMounter(t *testing.T) {
+	d, _, dir := newTestDriver(t)
+	defer os.RemoveAll(dir)
+
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep is not available")
+	}
+	// a mounter is started as 'mounterPath volumeName'
+	d.mounterPath = sleep
+	cmd := exec.Command(sleep, "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	if _, err := d.findMounter("61"); err == nil {
+		t.Error("found a mounter for another volume")
+	}
+	pid, err := d.findMounter("60")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid != cmd.Process.Pid {
+		t.Fatalf("found pid %d, expected %d", pid, cmd.Process.Pid)
+	}
+
+	proc := adoptMounterProcess("60", params.Mount{}, pid, time.Now())
+	if err := proc.rotateCredentials(params.Credentials{}, time.Second); err == nil {
+		t.Error("rotated the credentials of an adopted mounter")
+	}
+	select {
+	case <-proc.exited:
+		t.Fatal("adopted mounter exited while running")
+	default:
+	}
+
+	cmd.Process.Kill()
+	cmd.Wait()
+	waitFor(t, proc.exited, 10*time.Second, "the adopted mounter to exit")
+}
@@ -4,6 +4,7 @@ import (
 	"code.cloudfoundry.org/dockerdriver"
 	"code.cloudfoundry.org/dockerdriver/driverhttp"
 	"code.cloudfoundry.org/lager"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/kahing/goofys/api"
@@ -16,10 +17,12 @@ func (d *S3Driver) Unmount(env dockerdriver.Env, unmountRequest dockerdriver.Unm
 		return dockerdriver.ErrorResponse{Err: "Missing mandatory 'volume_name'"}
 	}
 
-	d.volumesLock.Lock()
-	defer d.volumesLock.Unlock()
+	unlock := d.volumeLocks.lock(unmountRequest.Name)
+	defer unlock()
 
+	d.volumesLock.RLock()
 	volume, ok := d.volumes[unmountRequest.Name]
+	d.volumesLock.RUnlock()
 	if !ok {
 		logger.Error("failed-no-such-volume-found", fmt.Errorf("could not find volume %s", unmountRequest.Name))
 
@@ -38,14 +41,22 @@ func (d *S3Driver) Unmount(env dockerdriver.Env, unmountRequest dockerdriver.Unm
 		}
 	}
 
+	d.volumesLock.Lock()
 	volume.MountCount--
-	logger.Info("volume-ref-count-decremented", lager.Data{"name": volume.Name, "count": volume.MountCount})
-
-	if volume.MountCount < 1 {
+	removed := volume.MountCount < 1
+	if removed {
 		delete(d.volumes, unmountRequest.Name)
 	}
+	d.volumesLock.Unlock()
+	logger.Info("volume-ref-count-decremented", lager.Data{"name": volume.Name, "count": volume.MountCount})
 
-	if err := d.persistState(driverhttp.EnvWithLogger(logger, env)); err != nil {
+	var err error
+	if removed {
+		err = d.removeVolumeState(driverhttp.EnvWithLogger(logger, env), unmountRequest.Name)
+	} else {
+		err = d.persistVolume(driverhttp.EnvWithLogger(logger, env), volume)
+	}
+	if err != nil {
 		return dockerdriver.ErrorResponse{Err: fmt.Sprintf("failed to persist state when unmounting: %s", err.Error())}
 	}
 
@@ -64,6 +75,8 @@ func (d *S3Driver) unmount(logger lager.Logger, name, mountPath, volumeName stri
 	}
 
 	if !exists {
+		d.supervisor.stop(volumeName)
+		d.wipeCache(driverhttp.NewHttpDriverEnv(logger, context.Background()), volumeName)
 		err := d.os.Remove(mountPath)
 		if err != nil {
 			errText := fmt.Sprintf("Volume %s does not exist (path: %s) and unable to remove mount directory", name, mountPath)
@@ -78,8 +91,10 @@ func (d *S3Driver) unmount(logger lager.Logger, name, mountPath, volumeName stri
 
 	logger.Info("unmount-volume-folder", lager.Data{"mountpath": mountPath})
 
+	d.supervisor.stop(volumeName)
 	err = goofys.TryUnmount(mountPath)
 	if err != nil {
+		d.supervisor.resume(volumeName)
 		logger.Error("unmount-failed", err)
 		return fmt.Errorf("Error unmounting volume: %s", err.Error())
 	}
@@ -90,7 +105,37 @@ func (d *S3Driver) unmount(logger lager.Logger, name, mountPath, volumeName stri
 		return fmt.Errorf("Error removing mountpoint: %s", err.Error())
 	}
 
+	d.wipeCache(driverhttp.NewHttpDriverEnv(logger, context.Background()), volumeName)
+
 	logger.Info("unmounted-volume")
 
 	return nil
 }
+
+// unmountStaleMounts lazily unmounts what a dead mounter left behind: its
+// mountpoint and, for a cached volume, the backing mount of the bucket in
+// cacheDir. A new mounter cannot start on top of either.
+func (d *S3Driver) unmountStaleMounts(env dockerdriver.Env, mountPoint, cacheDir string) error {
+	mountPoints := []string{mountPoint}
+	if cacheDir != "" {
+		mountPoints = append(mountPoints, cacheBackingDir(cacheDir))
+	}
+
+	var firstErr error
+	for _, path := range mountPoints {
+		mounted, err := d.mountChecker.Exists(path)
+		if err == nil && mounted {
+			err = d.unmountStale(env, path)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("unable to unmount stale mount %s: %s", path, err.Error())
+		}
+	}
+	return firstErr
+}
+
+// unmountStale lazily unmounts a mountpoint whose mounter is gone.
+func (d *S3Driver) unmountStale(env dockerdriver.Env, mountPath string) error {
+	_, err := d.invoker.Invoke(env, "umount", []string{"-l", "-f", mountPath})
+	return err
+}
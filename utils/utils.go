@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"fmt"
 	"log"
 	"os/user"
 	"strconv"
@@ -24,6 +25,24 @@ func VcapUserAndGroup() (uid int, gid int) {
 	return userAndGroup(vcap)
 }
 
+// LookupUserAndGroup resolves the uid and primary gid of a user name.
+func LookupUserAndGroup(username string) (uid int, gid int, err error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	uid64, err := strconv.ParseInt(u.Uid, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parsing UID (%s): %v", u.Uid, err)
+	}
+	gid64, err := strconv.ParseInt(u.Gid, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parsing GID (%s): %v", u.Gid, err)
+	}
+	return int(uid64), int(gid64), nil
+}
+
 func userAndGroup(u *user.User) (uid int, gid int) {
 	// Parse UID.
 	uid64, err := strconv.ParseInt(u.Uid, 10, 32)
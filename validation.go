@@ -0,0 +1,272 @@
+package s3driver
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/orange-cloudfoundry/s3-volume-driver/utils"
+	"math"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxPrefixLength = 512
+	maxCacheTTL     = 24 * time.Hour
+	maxHTTPTimeout  = 10 * time.Minute
+
+	defaultRoleSessionPrefix = "s3-volume-driver-"
+	maxRoleSessionNameLength = 64
+	maxExternalIDLength      = 1224
+)
+
+var (
+	roleARNPattern         = regexp.MustCompile(`^arn:[^:]+:iam::[^:]*:role/.+$`)
+	roleSessionNamePattern = regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+	externalIDPattern      = regexp.MustCompile(`^[\w+=,.@:/-]+$`)
+	roleSessionNameInvalid = regexp.MustCompile(`[^\w+=,.@-]`)
+	profilePattern         = regexp.MustCompile(`^[\w+=,.@/-]+$`)
+)
+
+// splitBucket extracts the prefix of a bucket given as 'bucket:prefix'.
+func splitBucket(bucket string) (string, string) {
+	parts := strings.SplitN(bucket, ":", 2)
+	if len(parts) == 1 {
+		return bucket, ""
+	}
+	return parts[0], parts[1]
+}
+
+// normalizePrefix strips the slashes around a prefix and checks that it is a
+// plain path of object keys.
+func normalizePrefix(prefix string) (string, error) {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return "", nil
+	}
+
+	if len(prefix) > maxPrefixLength {
+		return "", fmt.Errorf("'prefix' must not be longer than %d bytes", maxPrefixLength)
+	}
+	if !utf8.ValidString(prefix) {
+		return "", errors.New("'prefix' must be valid UTF-8")
+	}
+	for _, r := range prefix {
+		if unicode.IsControl(r) {
+			return "", errors.New("'prefix' must not contain control characters")
+		}
+	}
+	for _, segment := range strings.Split(prefix, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", fmt.Errorf("'prefix' contains an invalid path segment '%s'", segment)
+		}
+	}
+	return prefix, nil
+}
+
+// resolveOwnership turns the username of a volume into its uid and gid, and
+// checks the ownership and modes given to the volume.
+func resolveOwnership(connInfo *ConnectionInfo) error {
+	if connInfo.Username != "" {
+		if connInfo.Uid != nil || connInfo.Gid != nil {
+			return errors.New("'username' cannot be combined with 'uid' or 'gid'")
+		}
+		uid, gid, err := utils.LookupUserAndGroup(connInfo.Username)
+		if err != nil {
+			return fmt.Errorf("unable to resolve 'username' '%s'", connInfo.Username)
+		}
+		connInfo.Uid = &uid
+		connInfo.Gid = &gid
+	}
+
+	if connInfo.Uid != nil && (*connInfo.Uid < 0 || int64(*connInfo.Uid) >= math.MaxUint32) {
+		return fmt.Errorf("'uid' %d is out of range", *connInfo.Uid)
+	}
+	if connInfo.Gid != nil && (*connInfo.Gid < 0 || int64(*connInfo.Gid) >= math.MaxUint32) {
+		return fmt.Errorf("'gid' %d is out of range", *connInfo.Gid)
+	}
+
+	if _, err := parseMode("dir_mode", connInfo.DirMode); err != nil {
+		return err
+	}
+	if _, err := parseMode("file_mode", connInfo.FileMode); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseMode reads an octal permission mode such as '0750', an empty mode
+// parses as 0.
+func parseMode(name, mode string) (os.FileMode, error) {
+	if mode == "" {
+		return 0, nil
+	}
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("'%s' must be an octal permission mode between 0000 and 0777", name)
+	}
+	return os.FileMode(m), nil
+}
+
+// resolveTuning applies the tuning overrides of a volume on top of the
+// driver defaults.
+func resolveTuning(connInfo ConnectionInfo, defaults Tuning) (Tuning, error) {
+	tuning := defaults
+
+	var err error
+	if tuning.StatCacheTTL, err = parseDuration("stat_cache_ttl", connInfo.StatCacheTTL, defaults.StatCacheTTL, maxCacheTTL); err != nil {
+		return Tuning{}, err
+	}
+	if tuning.TypeCacheTTL, err = parseDuration("type_cache_ttl", connInfo.TypeCacheTTL, defaults.TypeCacheTTL, maxCacheTTL); err != nil {
+		return Tuning{}, err
+	}
+	if tuning.HTTPTimeout, err = parseDuration("http_timeout", connInfo.HTTPTimeout, defaults.HTTPTimeout, maxHTTPTimeout); err != nil {
+		return Tuning{}, err
+	}
+	if connInfo.Cheap != nil {
+		tuning.Cheap = *connInfo.Cheap
+	}
+	if connInfo.ExplicitDir != nil {
+		tuning.ExplicitDir = *connInfo.ExplicitDir
+	}
+	return tuning, nil
+}
+
+// parseDuration reads a duration such as '90s', an empty value gives def.
+func parseDuration(name, value string, def, max time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 || d > max {
+		return 0, fmt.Errorf("'%s' must be a duration between 0s and %s", name, max)
+	}
+	return d, nil
+}
+
+// parseExpiration reads a session token expiry given in RFC 3339.
+func parseExpiration(expiration string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, expiration)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("'session_token_expiration' must be an RFC 3339 date such as '2006-01-02T15:04:05Z'")
+	}
+	return t, nil
+}
+
+// hasOwnCredentials is true for volumes which do not need keys: anonymous
+// ones, the ones assuming a role and the ones using a profile.
+func hasOwnCredentials(connInfo ConnectionInfo) bool {
+	return connInfo.Anonymous || connInfo.RoleARN != "" || connInfo.Profile != ""
+}
+
+// checkProfile makes sure the profile of a volume exists in the driver
+// shared credentials file. A volume using a profile must not carry keys.
+func (d *S3Driver) checkProfile(connInfo ConnectionInfo) error {
+	if connInfo.Profile == "" {
+		return nil
+	}
+	if d.credentialsFile == "" {
+		return errors.New("'profile' is not available, the driver has no shared credentials file")
+	}
+	if connInfo.AccessKeyId != "" || connInfo.SecretAccessKey != "" || connInfo.SessionToken != "" || connInfo.RoleARN != "" || connInfo.Anonymous {
+		return errors.New("'profile' cannot be combined with 'access_key_id', 'secret_access_key', 'session_token', 'role_arn' or 'anonymous'")
+	}
+	if !profilePattern.MatchString(connInfo.Profile) {
+		return fmt.Errorf("'profile' '%s' is not a valid profile name", connInfo.Profile)
+	}
+	// keep the loading error out of the response, it may quote the file
+	if _, err := credentials.NewSharedCredentials(d.credentialsFile, connInfo.Profile).Get(); err != nil {
+		return fmt.Errorf("'profile' '%s' has no credentials in the driver shared credentials file", connInfo.Profile)
+	}
+	return nil
+}
+
+// resolveRole checks the role a volume assumes, if any, and defaults its
+// session name after the volume name. A volume assuming a role gets its
+// credentials from it and must not carry keys.
+func resolveRole(connInfo *ConnectionInfo, volumeName string) error {
+	if connInfo.RoleARN == "" {
+		if connInfo.ExternalID != "" || connInfo.RoleSessionName != "" {
+			return errors.New("'external_id' and 'role_session_name' require a 'role_arn'")
+		}
+		return nil
+	}
+
+	if connInfo.AccessKeyId != "" || connInfo.SecretAccessKey != "" || connInfo.SessionToken != "" {
+		return errors.New("'role_arn' cannot be combined with 'access_key_id', 'secret_access_key' or 'session_token'")
+	}
+	if !roleARNPattern.MatchString(connInfo.RoleARN) {
+		return fmt.Errorf("'role_arn' '%s' is not a role ARN such as 'arn:aws:iam::123456789012:role/name'", connInfo.RoleARN)
+	}
+	if connInfo.ExternalID != "" && (len(connInfo.ExternalID) < 2 || len(connInfo.ExternalID) > maxExternalIDLength || !externalIDPattern.MatchString(connInfo.ExternalID)) {
+		return fmt.Errorf("'external_id' must be 2 to %d characters among letters, digits and '+=,.@:/-_'", maxExternalIDLength)
+	}
+
+	if connInfo.RoleSessionName == "" {
+		name := defaultRoleSessionPrefix + roleSessionNameInvalid.ReplaceAllString(volumeName, "-")
+		if len(name) > maxRoleSessionNameLength {
+			name = name[:maxRoleSessionNameLength]
+		}
+		connInfo.RoleSessionName = name
+	}
+	if !roleSessionNamePattern.MatchString(connInfo.RoleSessionName) {
+		return fmt.Errorf("'role_session_name' must be 2 to %d characters among letters, digits and '+=,.@-_'", maxRoleSessionNameLength)
+	}
+	return nil
+}
+
+// checkCACert makes sure a ca_cert option only holds PEM certificates.
+func checkCACert(caCert string) error {
+	rest := []byte(caCert)
+	count := 0
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return fmt.Errorf("'ca_cert' must only contain certificates, found '%s'", block.Type)
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return fmt.Errorf("'ca_cert' contains an invalid certificate: %s", err.Error())
+		}
+		count++
+	}
+	if count == 0 || strings.TrimSpace(string(rest)) != "" {
+		return errors.New("'ca_cert' must be a PEM encoded certificate bundle")
+	}
+	return nil
+}
+
+// checkProxy makes sure http_proxy is a proxy URL. The URL itself is kept
+// out of the error as it may hold proxy credentials.
+func checkProxy(proxy string) error {
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") {
+		return errors.New("'http_proxy' must be a URL such as 'http://proxy.example.com:3128'")
+	}
+	return nil
+}
+
+// checkSSECKey makes sure sse_c_key is an AES-256 key and is the only
+// encryption asked for. The key itself never goes in errors.
+func checkSSECKey(connInfo ConnectionInfo) error {
+	if connInfo.UseSSE || connInfo.UseKMS {
+		return errors.New("'sse_c_key' cannot be combined with 'use_sse' or 'use_kms'")
+	}
+	key, err := base64.StdEncoding.DecodeString(connInfo.SSECKey)
+	if err != nil || len(key) != 32 {
+		return errors.New("'sse_c_key' must be a 256 bits key encoded in base64")
+	}
+	return nil
+}